@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// policies for the source files after the transfer
+const (
+	afterDustbin = "dustbin" // move the file to the dustbin
+	afterDelete  = "delete"  // remove the file from the source
+	afterRename  = "rename"  // rename the file with the rename suffix, renamed files are not transferred again
+	afterKeep    = "keep"    // leave the file in place and remember it in the state file, so it's not transferred again
+)
+
+// afterTransfer returns the policy for the source files after the transfer.
+func (c ExecutionConfig) afterTransfer() string {
+	if c.AfterTransfer == "" {
+		return afterDustbin
+	}
+	return c.AfterTransfer
+}
+
+func (c ExecutionConfig) renameSuffix() string {
+	if c.RenameSuffix == "" {
+		return ".transferred"
+	}
+	return c.RenameSuffix
+}
+
+// removesSource reports whether the transferred files are removed from the source folders,
+// only then the empty source folders are removed.
+func (c ExecutionConfig) removesSource() bool {
+	return c.afterTransfer() == afterDustbin || c.afterTransfer() == afterDelete
+}
+
+// usesDustbin reports whether files are moved to the dustbin, after the transfer or by a filter.
+func (c ExecutionConfig) usesDustbin() bool {
+	if c.afterTransfer() == afterDustbin {
+		return true
+	}
+	for _, rule := range c.Filters {
+		if rule.Action == filterDustbin && !strings.HasPrefix(rule.Pattern, "!") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ExecutionConfig) validateAfterTransfer() error {
+	switch c.afterTransfer() {
+	case afterDustbin, afterDelete, afterKeep:
+	case afterRename:
+		if strings.ContainsAny(c.renameSuffix(), `/\`) {
+			return errors.Errorf("invalid rename suffix: %s", c.RenameSuffix)
+		}
+	default:
+		return errors.Errorf("unsupported after-transfer policy: %s", c.AfterTransfer)
+	}
+	if c.afterTransfer() == afterKeep {
+		// the source may be read-only, nothing is removed or moved
+		for _, rule := range c.Filters {
+			if (rule.Action == filterDelete || rule.Action == filterDustbin) && !strings.HasPrefix(rule.Pattern, "!") {
+				return errors.Errorf("the filter %s can't %s files, the after-transfer policy keep doesn't modify the source", rule.Pattern, rule.Action)
+			}
+		}
+		if c.MaxFailures > 0 {
+			return errors.New("max-failures can't be combined with the after-transfer policy keep, failed files are not moved to the quarantine")
+		}
+	}
+	if c.Retention.enabled() && c.afterTransfer() != afterDustbin {
+		return errors.New("retention requires the after-transfer policy dustbin")
+	}
+	return nil
+}
+
+// transferredBefore reports whether the source file was left in the source after an earlier transfer,
+// it's renamed with the rename suffix or remembered in the state.
+func (c ExecutionConfig) transferredBefore(path string, info os.FileInfo, state *TransferState) bool {
+	switch c.afterTransfer() {
+	case afterRename:
+		return strings.HasSuffix(path, c.renameSuffix())
+	case afterKeep:
+		return state.kept(path, info)
+	}
+	return false
+}
+
+// finishSourceFile handles the transferred source file as the after-transfer policy says.
+// If a retention is set, the copies of a file moved to the dustbin are recorded,
+// so the file can be purged from the dustbin after they were verified again.
+func finishSourceFile(source DirFs, dustbin string, path string, copies *CopyRecord, config ExecutionConfig, state *TransferState) error {
+	var err error
+	switch config.afterTransfer() {
+	case afterDelete:
+		err = source.Remove(path)
+	case afterRename:
+		var renamed string
+		renamed, err = avoidExistsFile2(source, path+config.renameSuffix())
+		if err == nil {
+			err = source.Rename(path, renamed)
+		}
+	case afterKeep:
+		err = state.addKept(path, copies)
+	default:
+		err = source.Move(path, dustbin)
+	}
+	if err != nil {
+		return err
+	}
+	state.removeCopies(path)
+	if config.afterTransfer() == afterDustbin && config.Retention.enabled() {
+		state.addDustbinRecord(path, copies, config)
+	}
+	return nil
+}
+
+// sourceAfterTransfer describes what happens to the source file after the transfer, for the dry run.
+func sourceAfterTransfer(source DirFs, dustbin string, path string, config ExecutionConfig) (dustbinPath string, after string) {
+	switch config.afterTransfer() {
+	case afterDelete:
+		return "", "deleted"
+	case afterRename:
+		renamed, err := avoidExistsFile2(source, path+config.renameSuffix())
+		if err != nil {
+			renamed = path + config.renameSuffix()
+		}
+		return "", "renamed to " + renamed
+	case afterKeep:
+		return "", "kept"
+	}
+	return filepath.Join(dustbin, path), ""
+}
+
+// KeptRecord remembers a source file that was transferred and left in place.
+type KeptRecord struct {
+	Size        int64     `json:"size"`        // size of the source file
+	ModTime     time.Time `json:"mod-time"`    // modification time of the source file
+	Transferred time.Time `json:"transferred"` // time of the transfer
+}
+
+// kept reports whether the source file was transferred and left in place, a changed file is transferred again.
+func (s *TransferState) kept(path string, info os.FileInfo) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.Kept[path]
+	return ok && record.Size == info.Size() && record.ModTime.Equal(info.ModTime())
+}
+
+func (s *TransferState) addKept(path string, copies *CopyRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record := &KeptRecord{
+		Size:        copies.Size,
+		ModTime:     copies.ModTime,
+		Transferred: time.Now(),
+	}
+	s.Kept[path] = record
+	return appendJournal(s.journalPath(keptJournal), keptEntry{Path: path, Record: record})
+}
+
+// pruneKept forgets the kept files that were removed from the source.
+func (s *TransferState) pruneKept(listing *sourceListing) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for path := range s.Kept {
+		if !listing.removed(path) {
+			continue
+		}
+		delete(s.Kept, path)
+		if err := appendJournal(s.journalPath(keptJournal), keptEntry{Path: path}); err != nil {
+			s.logf("can't save kept files, the error is:\n%v", err)
+			return
+		}
+	}
+}
+
+// keptEntry is a line of the journal of the kept files.
+type keptEntry struct {
+	Path   string      `json:"path"`
+	Record *KeptRecord `json:"record,omitempty"` // nil if the file was forgotten
+}
+
+// loadKept replays the journal of the kept files.
+func (s *TransferState) loadKept() error {
+	return s.readJournal(s.journalPath(keptJournal), func(line []byte) error {
+		var entry keptEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		if entry.Record == nil {
+			delete(s.Kept, entry.Path)
+		} else {
+			s.Kept[entry.Path] = entry.Record
+		}
+		return nil
+	})
+}
+
+// keptEntries returns the current kept files, to compact the journal.
+func (s *TransferState) keptEntries() []interface{} {
+	var entries []interface{}
+	for path, record := range s.Kept {
+		entries = append(entries, keptEntry{Path: path, Record: record})
+	}
+	return entries
+}
+
+// sourceListing collects the paths found by a scan of the source. The walk is done by one goroutine,
+// so it's not locked.
+type sourceListing struct {
+	seen   map[string]bool // files and folders found by the scan
+	listed map[string]bool // folders whose content was read completely
+}
+
+func newSourceListing() *sourceListing {
+	return &sourceListing{
+		seen:   make(map[string]bool),
+		listed: make(map[string]bool),
+	}
+}
+
+// removed reports whether the path was removed from the source. It's only true if the path
+// or one of its folders is missing in a folder that was read completely, skipped or unreadable folders keep their paths.
+func (l *sourceListing) removed(path string) bool {
+	for p := path; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if l.listed[filepath.Dir(p)] {
+			return !l.seen[p]
+		}
+	}
+	return false
+}
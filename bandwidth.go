@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BandwidthConfig limits the transfer rate, the first schedule rule that contains the current time
+// sets the limit, otherwise the default limit applies.
+type BandwidthConfig struct {
+	Limit    float64         // default limit in MB/s, 0 means unlimited
+	Schedule []BandwidthRule // limits for time windows
+}
+
+// BandwidthRule sets the limit during a time window.
+type BandwidthRule struct {
+	TimeWindow `yaml:",inline"`
+	Limit      float64 // limit in MB/s, 0 means unlimited
+}
+
+func (c BandwidthConfig) validate() error {
+	if c.Limit < 0 {
+		return errors.Errorf("invalid bandwidth limit %v", c.Limit)
+	}
+	for _, rule := range c.Schedule {
+		if rule.Limit < 0 {
+			return errors.Errorf("invalid bandwidth limit %v", rule.Limit)
+		}
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enabled reports whether the transfer rate is limited at any time.
+func (c BandwidthConfig) enabled() bool {
+	if c.Limit > 0 {
+		return true
+	}
+	for _, rule := range c.Schedule {
+		if rule.Limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rateAt returns the limit in bytes per second at the time, 0 means unlimited.
+func (c BandwidthConfig) rateAt(t time.Time) float64 {
+	limit := c.Limit
+	for _, rule := range c.Schedule {
+		if rule.contains(t) {
+			limit = rule.Limit
+			break
+		}
+	}
+	return limit * 1024 * 1024
+}
+
+// tokenBucket limits the rate of the bytes taken from it. The rate is looked up in the schedule
+// every time bytes are taken, so a new limit applies to the transfers that are running.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	config BandwidthConfig
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil if the bandwidth is never limited.
+func newTokenBucket(config BandwidthConfig) *tokenBucket {
+	if !config.enabled() {
+		return nil
+	}
+	return &tokenBucket{
+		config: config,
+		last:   time.Now(),
+	}
+}
+
+// take blocks until n bytes may be transferred. Waiting transfers hold the lock,
+// so the bandwidth is shared by all transfers that use the bucket.
+func (b *tokenBucket) take(n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens -= float64(n)
+	for {
+		now := time.Now()
+		rate := b.config.rateAt(now)
+		if rate <= 0 {
+			// unlimited
+			b.tokens = 0
+			b.last = now
+			return
+		}
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		b.last = now
+		// allow a burst of one second
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+		if b.tokens >= 0 {
+			return
+		}
+		// wait at most one second, so a change of the limit is noticed
+		wait := time.Duration(-b.tokens / rate * float64(time.Second))
+		if wait > time.Second {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+	}
+}
+
+// maxLimitedRead is the largest read of a limited reader, smaller reads make the rate smoother.
+const maxLimitedRead = 64 * 1024
+
+// limitedReader takes the bytes that were read from all buckets.
+type limitedReader struct {
+	reader  io.Reader
+	buckets []*tokenBucket
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxLimitedRead {
+		p = p[:maxLimitedRead]
+	}
+	n, err := r.reader.Read(p)
+	for _, bucket := range r.buckets {
+		bucket.take(n)
+	}
+	return n, err
+}
+
+// limitedReaderAt takes the bytes that were read from all buckets.
+type limitedReaderAt struct {
+	reader  io.ReaderAt
+	buckets []*tokenBucket
+}
+
+func (r *limitedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		end := read + maxLimitedRead
+		if end > len(p) {
+			end = len(p)
+		}
+		n, err := r.reader.ReadAt(p[read:end], off+int64(read))
+		read += n
+		for _, bucket := range r.buckets {
+			bucket.take(n)
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// setBandwidth sets the buckets that limit the transfers, usually the global one and the one of the job.
+func (s *TransferState) setBandwidth(buckets ...*tokenBucket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bandwidth = nil
+	for _, bucket := range buckets {
+		if bucket != nil {
+			s.bandwidth = append(s.bandwidth, bucket)
+		}
+	}
+}
+
+// limitReader limits the rate of the reader by the bandwidth of the state.
+func (s *TransferState) limitReader(reader io.Reader) io.Reader {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.bandwidth) == 0 {
+		return reader
+	}
+	return &limitedReader{reader: reader, buckets: s.bandwidth}
+}
+
+// limitReaderAt limits the rate of the reader by the bandwidth of the state.
+func (s *TransferState) limitReaderAt(reader io.ReaderAt) io.ReaderAt {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.bandwidth) == 0 {
+		return reader
+	}
+	return &limitedReaderAt{reader: reader, buckets: s.bandwidth}
+}
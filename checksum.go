@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checksumNone disables the verification of the transferred files.
+const checksumNone = "none"
+
+// checksum returns the checksum algorithm, sha256 if none is configured.
+func (c ExecutionConfig) checksum() string {
+	if c.Checksum == "" {
+		return "sha256"
+	}
+	return c.Checksum
+}
+
+// verifies reports whether the transferred files are verified with a checksum.
+func (c ExecutionConfig) verifies() bool {
+	return !strings.EqualFold(c.checksum(), checksumNone)
+}
+
+// newHash creates the hash for the given checksum algorithm,
+// nil is returned if the algorithm is "none", which disables the verification.
+func newHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case checksumNone:
+		return nil, nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	}
+	return nil, errors.Errorf("unsupported checksum algorithm: %s", algorithm)
+}
+
+func hashSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashFile reads the file back from the file system and returns its checksum.
+func hashFile(dirfs DirFs, path string, algorithm string) (string, error) {
+	return hashFilePrefix(dirfs, path, -1, algorithm)
+}
+
+// hashFilePrefix returns the checksum of the first n bytes of the file, the whole file is hashed if n is negative.
+func hashFilePrefix(dirfs DirFs, path string, n int64, algorithm string) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if h == nil {
+		return "", errors.New("no checksum algorithm configured")
+	}
+	file, err := dirfs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	reader := &activityReader{reader: file}
+	if n < 0 {
+		_, err = io.Copy(h, reader)
+	} else {
+		_, err = io.CopyN(h, reader, n)
+	}
+	if err != nil {
+		return "", err
+	}
+	return hashSum(h), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const chunkBufferSize = 1024 * 1024
+
+// chunkedUploader is implemented by file systems that can upload a large file in parallel byte ranges.
+type chunkedUploader interface {
+	uploadStreams(size int64) int
+}
+
+// uploadStreams returns the number of parallel streams used to upload the given number of bytes to the file system,
+// 1 means the file is copied as a single stream.
+func uploadStreams(dirfs DirFs, size int64) int {
+	if uploader, ok := dirfs.(chunkedUploader); ok {
+		return uploader.uploadStreams(size)
+	}
+	return 1
+}
+
+func (c *DirFsConfig) chunkStreams() int {
+	if c.ChunkStreams <= 0 {
+		return 4
+	}
+	return c.ChunkStreams
+}
+
+// copyChunked copies the bytes from offset to size of the source to the same offsets of the destination,
+// the range is split into the given number of parts which are copied in parallel.
+// All parts stop at the first error.
+func copyChunked(ctx context.Context, dst io.WriterAt, src io.ReaderAt, offset int64, size int64, streams int, p *progress) (int64, error) {
+	remaining := size - offset
+	if remaining <= 0 {
+		return 0, nil
+	}
+	if int64(streams) > remaining {
+		streams = int(remaining)
+	}
+	chunkSize := (remaining + int64(streams) - 1) / int64(streams)
+	var written int64
+	var failed int32
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for start := offset; start < size; start += chunkSize {
+		end := start + chunkSize
+		if end > size {
+			end = size
+		}
+		wg.Add(1)
+		go func(start int64, end int64) {
+			defer wg.Done()
+			buf := make([]byte, chunkBufferSize)
+			for pos := start; pos < end && atomic.LoadInt32(&failed) == 0; {
+				n := int64(len(buf))
+				if end-pos < n {
+					n = end - pos
+				}
+				var read int
+				var err error
+				if ctx.Err() != nil {
+					// a local copy is not interrupted by closing the connections
+					err = errTransferAborted
+				} else {
+					read, err = readAt(src, buf[:n], pos, p)
+				}
+				if read > 0 {
+					var w int
+					w, err = dst.WriteAt(buf[:read], pos)
+					pos += int64(w)
+					atomic.AddInt64(&written, int64(w))
+					if p != nil && w > 0 {
+						p.touch()
+					}
+				}
+				if err == io.EOF && pos < end {
+					err = io.ErrUnexpectedEOF
+				}
+				if err != nil && err != io.EOF {
+					once.Do(func() {
+						firstErr = err
+						atomic.StoreInt32(&failed, 1)
+					})
+					return
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return atomic.LoadInt64(&written), firstErr
+}
+
+// readAt reads from the source, the read is recorded in the progress if there is one.
+func readAt(src io.ReaderAt, buf []byte, pos int64, p *progress) (int, error) {
+	if p == nil {
+		return src.ReadAt(buf, pos)
+	}
+	return p.read(func() (int, error) {
+		return src.ReadAt(buf, pos)
+	})
+}
+
+// copyChunkedWithTimeout is copyChunked with the idle timeout, the maximum duration and the abort of copyWithTimeout.
+func copyChunkedWithTimeout(ctx context.Context, dst io.WriterAt, src io.ReaderAt, offset int64, size int64, streams int, idleTimeout time.Duration, maxDuration time.Duration, abort transferAborter) (int64, error) {
+	if idleTimeout <= 0 && maxDuration <= 0 && ctx.Done() == nil {
+		return copyChunked(ctx, dst, src, offset, size, streams, nil)
+	}
+	return watchTransfer(ctx, idleTimeout, maxDuration, abort, func(p *progress) (int64, error) {
+		return copyChunked(ctx, dst, src, offset, size, streams, p)
+	})
+}
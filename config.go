@@ -2,29 +2,80 @@ package main
 
 import (
 	"io/ioutil"
+	"path/filepath"
+	"reflect"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
 type DirFsConfig struct {
-	Type         FsType
-	Host         string
-	Port         int
-	Path         string // root dir path
-	ShareName    string `yaml:"share-name"` // share name of smb server
-	IdentityFile string `yaml:"identity-file"`
-	Username     string
-	Password     string
-	Domain       string
-	KnownHosts   string `yaml:"known-hosts"` // hosts file location
+	Type                FsType
+	Host                string
+	Port                int
+	Path                string // root dir path
+	ShareName           string `yaml:"share-name"` // share name of smb server
+	IdentityFile        string `yaml:"identity-file"`
+	Username            string
+	Password            string
+	Domain              string
+	KnownHosts          string `yaml:"known-hosts"`           // hosts file location
+	ConnectTimeout      int    `yaml:"connect-timeout"`       // timeout in seconds to connect to the server, default is 10
+	ReconnectAttempts   int    `yaml:"reconnect-attempts"`    // number of reconnect attempts when an operation fails because of a broken connection, default is 3
+	HealthCheckInterval int    `yaml:"health-check-interval"` // the connection is checked with a keepalive if it was not checked for this number of seconds, default is 60
+	ChunkThresholdMB    int    `yaml:"chunk-threshold-mb"`    // sftp only, files of at least this size in MB are uploaded in parallel byte ranges, 0 disables it
+	ChunkStreams        int    `yaml:"chunk-streams"`         // number of parallel byte ranges of a chunked upload, default is 4
+	Watch               bool   // local only, scan the source when inotify reports a change instead of polling
+	RescanInterval      int    `yaml:"rescan-interval"` // in watch mode, the source is scanned at least every this number of seconds, default is 600
 }
 
 type ExecutionConfig struct {
-	StartLevel int  `yaml:"start-level"` // Files parallel to the start level are ignored, all files should be placed in the start level directory or deeper.
-	Overwrite  bool // Overwrite existing file on the remote server
-	Gid        int  // if not zero, will be used to set file group on destination
-	Uid        int  // if gid is not zero, a correct uid value should be set on destination
+	StartLevel           int             `yaml:"start-level"` // Files parallel to the start level are ignored, all files should be placed in the start level directory or deeper.
+	Overwrite            bool            // Overwrite existing file on the remote server
+	Gid                  int             // if not zero, will be used to set file group on destination
+	Uid                  int             // if gid is not zero, a correct uid value should be set on destination
+	Checksum             string          // checksum algorithm (sha256, sha1, md5 or crc32) used to verify the destination file before the source is moved to the dustbin, default is sha256, none to disable
+	ResumeVerify         bool            `yaml:"resume-verify"`           // compare the checksum of the transferred part before an interrupted transfer is resumed
+	StableScans          int             `yaml:"stable-scans"`            // a file is only transferred after its size and modification time stayed the same for this number of scans
+	StableSeconds        int             `yaml:"stable-seconds"`          // a file is only transferred after its size and modification time stayed the same for this number of seconds
+	DatasetMarker        string          `yaml:"dataset-marker"`          // a dataset folder at the start level is only transferred after this file exists in it
+	DatasetIdleSeconds   int             `yaml:"dataset-idle-seconds"`    // a dataset folder at the start level is only transferred after its content didn't change for this number of seconds
+	MarkerToDest         bool            `yaml:"marker-to-dest"`          // transfer the marker file as the last file of the dataset, otherwise it's removed
+	StageDatasets        bool            `yaml:"stage-datasets"`          // write the dataset folders at the start level to the staging folder and publish them after they are complete
+	StagingDir           string          `yaml:"staging-dir"`             // staging folder on the destination, relative to the destination path, default is .incoming
+	RetrySeconds         int             `yaml:"retry-seconds"`           // wait time before a failed file is retried, it doubles with every failure, default is 5
+	RetryMaxSeconds      int             `yaml:"retry-max-seconds"`       // maximum wait time before a failed file is retried, default is 3600
+	MaxFailures          int             `yaml:"max-failures"`            // a file is moved to the quarantine folder after this number of failures, 0 to retry forever
+	IdleTimeout          int             `yaml:"idle-timeout"`            // abort a transfer if no data was transferred for this number of seconds, 0 to disable
+	TransferTimeoutPerGB int             `yaml:"transfer-timeout-per-gb"` // abort a transfer if it takes longer than this number of seconds per started GB, 0 to disable
+	Workers              int             // number of files transferred in parallel, default is 1
+	Bandwidth            BandwidthConfig // bandwidth limit of the transfers of this job
+	Windows              TransferWindows `yaml:"transfer-windows"` // calendar of the times transfers may run
+	PollInterval         int             `yaml:"poll-interval"`    // seconds to wait between two scans of the source, default is 5
+	ShutdownGrace        int             `yaml:"shutdown-grace"`   // seconds the running transfers may take to finish when the program is stopped, default is 30
+	Filters              []FilterRule    // rules for the source files that are not transferred, they are skipped, removed or moved to the dustbin
+	Retention            RetentionConfig // purge the files from the dustbin after their copies were verified
+	AfterTransfer        string          `yaml:"after-transfer"` // what happens to the source files after the transfer: dustbin (default), delete, rename or keep
+	RenameSuffix         string          `yaml:"rename-suffix"`  // suffix of the renamed source files with the after-transfer policy rename, default is .transferred
+}
+
+// DestinationConfig is one of the destinations of a job.
+type DestinationConfig struct {
+	Name        string // name of the destination, it's kept in the state file
+	DirFsConfig `yaml:",inline"`
+	Optional    bool // the source file is moved to the dustbin even if the copy to this destination failed
+}
+
+// JobConfig is a transfer from a source to a destination, the jobs of a config run concurrently.
+type JobConfig struct {
+	Name       string // name of the job, it prefixes the log messages of the job
+	Source     DirFsConfig
+	Dest       DirFsConfig
+	Dests      []DestinationConfig // several destinations, every file is copied to all of them, can't be combined with dest
+	Dustbin    string
+	Quarantine string // files that failed too many times are moved to this folder, default is a folder next to the dustbin
+	StateFile  string `yaml:"state-file"` // file that keeps the transfer state of the job, default is tohpc-state-<name>.json
+	Execution  ExecutionConfig
 }
 
 type AppConfig struct {
@@ -32,11 +83,15 @@ type AppConfig struct {
 	Dest       DirFsConfig
 	Dustbin    string
 	Execution  ExecutionConfig
-	KnownHosts string `yaml:"known-hosts"` // hosts file location
+	KnownHosts string          `yaml:"known-hosts"` // hosts file location
+	StateFile  string          `yaml:"state-file"`  // file that keeps the transfer state between restarts
+	Quarantine string          // files that failed too many times are moved to this folder, default is a folder next to the dustbin
+	Bandwidth  BandwidthConfig // global bandwidth limit of all transfers
+	Jobs       []JobConfig     // jobs that run concurrently, if it's empty, source, dest and dustbin are the only job
 }
 
 func LoadAppConfig(path string, secret string) (*AppConfig, error) {
-	config := AppConfig{}
+	var config AppConfig
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "can not open config file")
@@ -45,23 +100,146 @@ func LoadAppConfig(path string, secret string) (*AppConfig, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "can not unmarshal config data")
 	}
-	if secret != "" {
-		err = decryptConfig(&config.Source, secret)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot decrypt source password")
-		}
-		err = decryptConfig(&config.Dest, secret)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot decrypt dest password")
-		}
+	if err = config.Bandwidth.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid bandwidth config")
 	}
 	if config.KnownHosts != "" {
 		config.Source.KnownHosts = config.KnownHosts
 		config.Dest.KnownHosts = config.KnownHosts
 	}
+	if len(config.Jobs) == 0 {
+		// a config without jobs is a single job without name
+		if config.StateFile == "" {
+			config.StateFile = "tohpc-state.json"
+		}
+		config.Jobs = []JobConfig{{
+			Source:     config.Source,
+			Dest:       config.Dest,
+			Dustbin:    config.Dustbin,
+			Quarantine: config.Quarantine,
+			StateFile:  config.StateFile,
+			Execution:  config.Execution,
+		}}
+	} else if config.Source.Type != "" || config.Dest.Type != "" || config.Dustbin != "" ||
+		config.Quarantine != "" || config.StateFile != "" || !reflect.DeepEqual(config.Execution, ExecutionConfig{}) {
+		// they are not inherited by the jobs
+		return nil, errors.New("source, dest, dustbin, quarantine, state-file and execution can't be combined with jobs, move them into a job")
+	}
+	names := make(map[string]bool)
+	stateFiles := make(map[string]bool)
+	for i := range config.Jobs {
+		job := &config.Jobs[i]
+		if len(config.Jobs) > 1 || job.Name != "" {
+			if job.Name == "" {
+				return nil, errors.Errorf("job %d has no name", i+1)
+			}
+			if names[job.Name] {
+				return nil, errors.Errorf("duplicate job name %s", job.Name)
+			}
+			names[job.Name] = true
+			if job.StateFile == "" {
+				job.StateFile = "tohpc-state-" + job.Name + ".json"
+			}
+		}
+		if job.StateFile != "" {
+			if stateFiles[job.StateFile] {
+				return nil, errors.Errorf("job %s uses the state file %s of another job", job.Name, job.StateFile)
+			}
+			stateFiles[job.StateFile] = true
+		}
+		err = job.prepare(config.KnownHosts, secret)
+		if err != nil {
+			if job.Name != "" {
+				return nil, errors.Wrapf(err, "invalid job %s", job.Name)
+			}
+			return nil, err
+		}
+	}
 	return &config, nil
 }
 
+// prepare validates the config of the job, decrypts the passwords and sets the defaults.
+func (job *JobConfig) prepare(knownHosts string, secret string) error {
+	var err error
+	if _, err = newHash(job.Execution.checksum()); err != nil {
+		return errors.Wrap(err, "invalid checksum config")
+	}
+	if err = job.Execution.Bandwidth.validate(); err != nil {
+		return errors.Wrap(err, "invalid execution bandwidth config")
+	}
+	if err = job.Execution.Windows.validate(); err != nil {
+		return errors.Wrap(err, "invalid transfer windows config")
+	}
+	if _, err = job.Execution.filters(); err != nil {
+		return errors.Wrap(err, "invalid filters config")
+	}
+	if err = job.Execution.validateAfterTransfer(); err != nil {
+		return errors.Wrap(err, "invalid after-transfer config")
+	}
+	if job.Execution.Retention.enabled() && !job.Execution.verifies() {
+		return errors.New("retention requires a checksum, the copies can't be verified without it")
+	}
+	if len(job.Dests) == 0 {
+		// a job without dests has the only destination dest
+		job.Dests = []DestinationConfig{{DirFsConfig: job.Dest}}
+	} else if job.Dest.Type != "" {
+		return errors.New("dest can't be combined with dests")
+	}
+	if err = validateDests(job.Dests); err != nil {
+		return err
+	}
+	if secret != "" {
+		err = decryptConfig(&job.Source, secret)
+		if err != nil {
+			return errors.Wrap(err, "cannot decrypt source password")
+		}
+		for i := range job.Dests {
+			err = decryptConfig(&job.Dests[i].DirFsConfig, secret)
+			if err != nil {
+				return errors.Wrap(err, "cannot decrypt dest password")
+			}
+		}
+	}
+	if job.Quarantine == "" && job.Dustbin != "" {
+		// the quarantine is a folder next to the dustbin
+		job.Quarantine = filepath.Join(filepath.Dir(filepath.Clean(job.Dustbin)), "quarantine")
+	}
+	if job.Execution.MaxFailures > 0 && job.Quarantine == "" {
+		return errors.New("max-failures requires a quarantine folder, set quarantine or dustbin")
+	}
+	if knownHosts != "" {
+		job.Source.KnownHosts = knownHosts
+		for i := range job.Dests {
+			job.Dests[i].KnownHosts = knownHosts
+		}
+	}
+	return nil
+}
+
+// validateDests checks that several destinations have unique names and at least one of them is required.
+func validateDests(dests []DestinationConfig) error {
+	names := make(map[string]bool)
+	required := false
+	for i, dest := range dests {
+		if len(dests) > 1 {
+			if dest.Name == "" {
+				return errors.Errorf("dest %d has no name", i+1)
+			}
+			if names[dest.Name] {
+				return errors.Errorf("duplicate dest name %s", dest.Name)
+			}
+			names[dest.Name] = true
+		}
+		if !dest.Optional {
+			required = true
+		}
+	}
+	if !required {
+		return errors.New("all dests are optional, at least one must be required")
+	}
+	return nil
+}
+
 func decryptConfig(config *DirFsConfig, secret string) error {
 	if secret == "" {
 		return nil
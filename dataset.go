@@ -0,0 +1,229 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// datasetRecord tracks a dataset directory at the start level while it's waiting for completion.
+type datasetRecord struct {
+	ready      bool      // the dataset is transferred in the current scan
+	incomplete bool      // a file of the dataset failed or was skipped in the current scan
+	seen       bool      // the dataset was seen in the current scan
+	scanned    bool      // the content of the dataset was scanned at least once
+	lastChange time.Time // time the content of the dataset was last seen changing
+	// summary of the content, a change of it restarts the idle time
+	files   int
+	size    int64
+	modTime time.Time
+	// summary collected in the current scan
+	scanFiles   int
+	scanSize    int64
+	scanModTime time.Time
+}
+
+// datasetMode reports whether datasets are only transferred after they are complete.
+func (c ExecutionConfig) datasetMode() bool {
+	return c.StartLevel > 0 && (c.DatasetMarker != "" || c.DatasetIdleSeconds > 0)
+}
+
+// stagingMode reports whether datasets are written to the staging folder and published after they are complete.
+func (c ExecutionConfig) stagingMode() bool {
+	return c.StartLevel > 0 && c.StageDatasets
+}
+
+// trackDatasets reports whether the state of the datasets must be tracked while walking the source.
+func (c ExecutionConfig) trackDatasets() bool {
+	return c.datasetMode() || c.stagingMode()
+}
+
+func (c ExecutionConfig) stagingDir() string {
+	if c.StagingDir == "" {
+		return ".incoming"
+	}
+	return c.StagingDir
+}
+
+// datasetOf returns the dataset directory at the start level the path belongs to,
+// empty if the path is not inside a dataset.
+func datasetOf(path string, startLevel int) string {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	if len(parts) <= startLevel {
+		return ""
+	}
+	return filepath.Join(parts[:startLevel]...)
+}
+
+// datasetOfDir returns the dataset a directory at the level belongs to, the dataset is the directory itself
+// if it's at the start level.
+func datasetOfDir(path string, level int, startLevel int) string {
+	if level == startLevel {
+		return path
+	}
+	return datasetOf(path, startLevel)
+}
+
+// stagingPath returns the destination path of a path in the dataset,
+// the dataset is written to the staging folder if staging is enabled.
+func stagingPath(path string, dataset string, config ExecutionConfig) string {
+	if !config.stagingMode() || dataset == "" {
+		return path
+	}
+	return filepath.Join(config.stagingDir(), path)
+}
+
+// isDatasetMarker reports whether the file is the completion marker of its dataset.
+func isDatasetMarker(path string, config ExecutionConfig) bool {
+	return config.DatasetMarker != "" &&
+		filepath.Base(path) == config.DatasetMarker &&
+		filepath.Dir(path) == datasetOf(path, config.StartLevel)
+}
+
+// enterDataset decides whether the dataset is transferred in this scan,
+// it's complete if the marker file exists, or if its content didn't change for the idle time.
+func (s *TransferState) enterDataset(source DirFs, path string, config ExecutionConfig) bool {
+	ready := !config.datasetMode()
+	if config.DatasetMarker != "" {
+		_, err := source.Lstat(filepath.Join(path, config.DatasetMarker))
+		ready = err == nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.datasets[path]
+	if !ok {
+		record = &datasetRecord{}
+		s.datasets[path] = record
+	}
+	if !ready && config.DatasetIdleSeconds > 0 && record.scanned {
+		ready = time.Since(record.lastChange) >= time.Duration(config.DatasetIdleSeconds)*time.Second
+	}
+	record.ready = ready
+	record.incomplete = false
+	record.seen = true
+	record.scanFiles = 0
+	record.scanSize = 0
+	record.scanModTime = time.Time{}
+	return ready
+}
+
+// datasetReady reports whether the dataset of the path is transferred in this scan,
+// the file info is added to the content summary of the dataset if it's not nil.
+func (s *TransferState) datasetReady(path string, info os.FileInfo, config ExecutionConfig) bool {
+	dataset := datasetOf(path, config.StartLevel)
+	if dataset == "" {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.datasets[dataset]
+	if !ok {
+		return false
+	}
+	if info != nil {
+		record.scanFiles++
+		record.scanSize += info.Size()
+		if info.ModTime().After(record.scanModTime) {
+			record.scanModTime = info.ModTime()
+		}
+	}
+	return record.ready
+}
+
+// datasetIncomplete marks the dataset as incomplete in this scan.
+func (s *TransferState) datasetIncomplete(dataset string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if record, ok := s.datasets[dataset]; ok {
+		record.incomplete = true
+	}
+}
+
+// exitDataset finishes the scan of the dataset, it returns whether the dataset was transferred in this scan
+// and whether some of its files failed or were skipped.
+func (s *TransferState) exitDataset(path string) (ready bool, incomplete bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.datasets[path]
+	if !ok {
+		return false, false
+	}
+	if !record.ready {
+		if !record.scanned || record.scanFiles != record.files || record.scanSize != record.size || !record.scanModTime.Equal(record.modTime) {
+			record.lastChange = time.Now()
+		}
+		record.scanned = true
+		record.files = record.scanFiles
+		record.size = record.scanSize
+		record.modTime = record.scanModTime
+	}
+	return record.ready, record.incomplete
+}
+
+// removeDataset forgets the dataset after it was transferred completely.
+func (s *TransferState) removeDataset(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.datasets, path)
+}
+
+// publishDataset moves the staged dataset to its final place on the destination.
+// If the dataset already exists on the destination, the staged files are merged into it.
+func publishDataset(dest DirFs, dataset string, config ExecutionConfig) error {
+	staged := stagingPath(dataset, dataset, config)
+	_, err := dest.Lstat(staged)
+	if os.IsNotExist(err) {
+		// nothing was staged
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = dest.Lstat(dataset)
+	if os.IsNotExist(err) {
+		err = dest.MkdirAll(filepath.Dir(dataset))
+		if err != nil {
+			return err
+		}
+		return dest.Rename(staged, dataset)
+	}
+	if err != nil {
+		return err
+	}
+	return mergeStagedDir(dest, staged, dataset, config)
+}
+
+// mergeStagedDir moves the content of the staged directory into the existing directory,
+// existing files are renamed if overwrite is disabled.
+func mergeStagedDir(dest DirFs, staged string, target string, config ExecutionConfig) error {
+	files, err := dest.ReadDir(staged)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		stagedPath := filepath.Join(staged, file.Name())
+		targetPath := filepath.Join(target, file.Name())
+		if file.IsDir() {
+			err = dest.MkdirAll(targetPath)
+			if err == nil {
+				dest.Chown(targetPath, config.Uid, config.Gid)
+				err = mergeStagedDir(dest, stagedPath, targetPath, config)
+			}
+		} else if isPartialFile(stagedPath) {
+			// left by a transfer that won't be resumed, the dataset is complete
+			err = dest.Remove(stagedPath)
+		} else {
+			if !config.Overwrite {
+				targetPath, err = avoidExistsFile2(dest, targetPath)
+			}
+			if err == nil {
+				err = dest.Rename(stagedPath, targetPath)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return dest.Remove(staged)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// destination is a destination of a job, a file is copied to all destinations of the job
+// before the source file is moved to the dustbin.
+type destination struct {
+	DirFs
+	name     string // name of the destination, empty if the job has only one destination
+	root     string // root folder of the destination, shown by the dry run
+	optional bool   // the source file is moved to the dustbin even if the copy to this destination failed
+}
+
+// label names the destination in log messages.
+func (d *destination) label() string {
+	if d.name == "" {
+		return "destination"
+	}
+	return "destination " + d.name
+}
+
+// available connects to the destination, an error is returned if it's not available.
+func (d *destination) available() error {
+	if managed, ok := d.DirFs.(*ManagedDirFs); ok {
+		_, err := managed.fs()
+		return err
+	}
+	return nil
+}
+
+// resumeKey returns the key of the resume record of a transfer of the file to the destination.
+func (d *destination) resumeKey(path string) string {
+	if d.name == "" {
+		return path
+	}
+	return d.name + ":" + path
+}
+
+// ownsResumeKey reports whether the resume record of the key belongs to a transfer to the destination.
+func (d *destination) ownsResumeKey(key string) bool {
+	return d.name == "" || strings.HasPrefix(key, d.name+":")
+}
+
+// CopyRecord lists the destinations that have a verified copy of a source file,
+// so a retry only copies the file to the other destinations.
+type CopyRecord struct {
+	Size    int64             `json:"size"`          // size of the source file
+	ModTime time.Time         `json:"mod-time"`      // modification time of the source file
+	Targets map[string]string `json:"targets"`       // target path by destination name
+	Sum     string            `json:"sum,omitempty"` // checksum of the source file, empty if the checksum is none
+}
+
+func (r *CopyRecord) matches(info os.FileInfo) bool {
+	return r.Size == info.Size() && r.ModTime.Equal(info.ModTime())
+}
+
+// copied reports whether the destination has a copy of the source file, the copy is ignored if the source file changed.
+func (s *TransferState) copied(path string, info os.FileInfo, dest string) bool {
+	_, _, ok := s.copyOf(path, info, dest)
+	return ok
+}
+
+// copyOf returns the target path and the checksum of the copy of the source file on the destination.
+func (s *TransferState) copyOf(path string, info os.FileInfo, dest string) (string, string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.Copies[path]
+	if !ok || !record.matches(info) {
+		return "", "", false
+	}
+	target, ok := record.Targets[dest]
+	return target, record.Sum, ok
+}
+
+// addCopy records the copy of the source file on the destination.
+func (s *TransferState) addCopy(path string, info os.FileInfo, dest string, target string, sum string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.Copies[path]
+	if !ok || !record.matches(info) {
+		record = &CopyRecord{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Targets: make(map[string]string),
+		}
+		s.Copies[path] = record
+	}
+	record.Targets[dest] = target
+	record.Sum = sum
+	return s.save()
+}
+
+// removeCopies forgets the copies of the source file after it was moved to the dustbin.
+func (s *TransferState) removeCopies(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.Copies[path]; !ok {
+		return
+	}
+	delete(s.Copies, path)
+	if err := s.save(); err != nil {
+		s.logf("can't save transfer state, the error is:\n%v", err)
+	}
+}
+
+// copyToDestinations transfers the file to the destinations that don't have a copy yet, targetOf returns
+// the target path on a destination. The copies are recorded, so a retry only fills in the missing copies.
+// An error is returned if a required destination has no copy, a failed copy to an optional destination is only logged.
+// The returned record lists all copies of the file.
+func copyToDestinations(ctx context.Context, source DirFs, dests []*destination, path string, info fs.FileInfo, targetOf func(dest *destination) (string, error), config ExecutionConfig, state *TransferState) (*CopyRecord, error) {
+	copies := &CopyRecord{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Targets: make(map[string]string),
+	}
+	var failed error
+	for _, dest := range dests {
+		if len(dests) > 1 {
+			if target, sum, ok := state.copyOf(path, info, dest.name); ok {
+				copies.Targets[dest.name] = target
+				copies.Sum = sum
+				continue
+			}
+		}
+		targetPath, err := targetOf(dest)
+		var sum string
+		if err == nil {
+			sum, err = transferFile(ctx, source, dest, path, info, targetPath, config, state)
+		}
+		if errors.Is(err, errTransferAborted) || err == errFileNotReady {
+			// the other destinations are tried again later
+			return nil, err
+		}
+		if err != nil {
+			if dest.optional {
+				state.logf("can't copy file %s to the optional %s, the error is:\n%v", path, dest.label(), err)
+			} else if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		copies.Targets[dest.name] = targetPath
+		copies.Sum = sum
+		if len(dests) > 1 {
+			if err = state.addCopy(path, info, dest.name, targetPath, sum); err != nil {
+				state.logf("can't save transfer state, the error is:\n%v", err)
+			}
+		}
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	return copies, nil
+}
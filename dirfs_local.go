@@ -22,25 +22,36 @@ type LocalDirFs struct {
 }
 
 func (fs *LocalDirFs) Walk(enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) {
-	fs.walkDir(".", 1, enterDir, enterFile, exitDir)
+	err := fs.walkDir(".", 1, enterDir, enterFile, exitDir)
+	if err != nil {
+		exitDir(".", nil, 0, err)
+	}
 }
 
-func (fs *LocalDirFs) walkDir(dir string, level int, enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) {
-	dirpath := fs.abspath(dir)
-	files, err := ioutil.ReadDir(dirpath)
+// walkDir walks the content of the directory, the error is returned if the directory can't be read.
+func (fs *LocalDirFs) walkDir(dir string, level int, enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) error {
+	files, err := fs.ReadDir(dir)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	for _, file := range files {
 		relpath := filepath.Join(dir, file.Name())
 		if file.IsDir() {
-			enterDir(relpath, iofs.FileInfoToDirEntry(file), level, nil)
-			fs.walkDir(relpath, level+1, enterDir, enterFile, exitDir)
-			exitDir(relpath, iofs.FileInfoToDirEntry(file), level, nil)
+			if enterDir(relpath, iofs.FileInfoToDirEntry(file), level, nil) == iofs.SkipDir {
+				continue
+			}
+			// an unreadable directory is reported to exitDir
+			err = fs.walkDir(relpath, level+1, enterDir, enterFile, exitDir)
+			exitDir(relpath, iofs.FileInfoToDirEntry(file), level, err)
 		} else {
 			enterFile(relpath, file, level, nil)
 		}
 	}
+	return nil
+}
+
+func (fs *LocalDirFs) ReadDir(path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(fs.abspath(path))
 }
 
 func (fs *LocalDirFs) MkdirAll(path string) error {
@@ -53,17 +64,22 @@ func (fs *LocalDirFs) MkdirAllAbs(rootpath string, relpath string) error {
 	return os.MkdirAll(abspath, DirFileMode)
 }
 
-func (fs *LocalDirFs) Open(path string) (io.ReadWriteCloser, error) {
+func (fs *LocalDirFs) Open(path string) (File, error) {
 	abspath := fs.abspath(path)
 	return os.Open(abspath)
 }
 
-func (fs *LocalDirFs) Create(path string) (io.ReadWriteCloser, error) {
+func (fs *LocalDirFs) Create(path string) (File, error) {
 	abspath := fs.abspath(path)
 	return os.Create(abspath)
 }
 
-func (fs *LocalDirFs) OpenFile(name string, flag int, perm fs.FileMode) (io.ReadWriteCloser, error) {
+func (fs *LocalDirFs) CreateAbs(rootpath string, relpath string) (File, error) {
+	abspath := filepath.Join(rootpath, relpath)
+	return os.Create(abspath)
+}
+
+func (fs *LocalDirFs) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
 	abspath := fs.abspath(name)
 	return os.OpenFile(abspath, flag, perm)
 }
@@ -101,17 +117,29 @@ func (fs *LocalDirFs) Move(path string, dest string) error {
 	return os.Rename(srcpath, destpath)
 }
 
+func (fs *LocalDirFs) Rename(oldpath string, newpath string) error {
+	return os.Rename(fs.abspath(oldpath), fs.abspath(newpath))
+}
+
 func (fs *LocalDirFs) Lstat(p string) (os.FileInfo, error) {
 	return os.Lstat(fs.abspath(p))
 }
 
+// withRoot returns a copy of the file system with another root folder.
+func (fs *LocalDirFs) withRoot(path string) DirFs {
+	rooted := *fs
+	rooted.Path = path
+	return &rooted
+}
+
 var _ DirFs = (*LocalDirFs)(nil)
+var _ rootedDirFs = (*LocalDirFs)(nil)
 
 type LocalDirFsCreator struct {
 	fs *LocalDirFs
 }
 
-func (c *LocalDirFsCreator) create() (DirFs, error) {
+func (c *LocalDirFsCreator) create(job string) (DirFs, error) {
 	return c.fs, nil
 }
 
@@ -119,6 +147,10 @@ func (c *LocalDirFsCreator) close() {
 
 }
 
+func (c *LocalDirFsCreator) invalidate(dirfs DirFs) {
+
+}
+
 var _ DirFsCreator = (*LocalDirFsCreator)(nil)
 
 func createLocalDirFsCreator(config DirFsConfig) (DirFsCreator, error) {
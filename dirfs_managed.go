@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ManagedDirFs gets the file system from its creator for every operation,
+// so a connection that was invalidated is created again for the next operation.
+// Operations that fail because of a broken connection are retried after reconnecting.
+type ManagedDirFs struct {
+	creator  DirFsCreator
+	attempts int    // number of reconnect attempts
+	job      string // name of the job, it prefixes the log messages
+}
+
+func newManagedDirFs(creator DirFsCreator, config DirFsConfig, job string) *ManagedDirFs {
+	return &ManagedDirFs{
+		creator:  creator,
+		attempts: config.reconnectAttempts(),
+		job:      job,
+	}
+}
+
+func (m *ManagedDirFs) fs() (DirFs, error) {
+	return m.creator.create(m.job)
+}
+
+// Walk reads the folders with ReadDir, so the walk reconnects and goes on if the connection breaks in the middle.
+func (m *ManagedDirFs) Walk(enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) {
+	err := walkDirFs(m, ".", 1, enterDir, enterFile, exitDir)
+	if err != nil {
+		exitDir(".", nil, 0, err)
+	}
+}
+
+// walkDirFs walks the content of the directory, the error is returned if the directory can't be read.
+func walkDirFs(dirfs DirFs, dir string, level int, enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) error {
+	files, err := dirfs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		relpath := filepath.Join(dir, file.Name())
+		if file.IsDir() {
+			if enterDir(relpath, fs.FileInfoToDirEntry(file), level, nil) == fs.SkipDir {
+				continue
+			}
+			// an unreadable directory is reported to exitDir
+			err = walkDirFs(dirfs, relpath, level+1, enterDir, enterFile, exitDir)
+			exitDir(relpath, fs.FileInfoToDirEntry(file), level, err)
+		} else {
+			enterFile(relpath, file, level, nil)
+		}
+	}
+	return nil
+}
+
+func (m *ManagedDirFs) ReadDir(path string) ([]os.FileInfo, error) {
+	var result []os.FileInfo
+	err := m.retry(func(dirfs DirFs) error {
+		var err error
+		result, err = dirfs.ReadDir(path)
+		return err
+	})
+	return result, err
+}
+
+func (m *ManagedDirFs) MkdirAll(path string) error {
+	return m.retry(func(dirfs DirFs) error {
+		return dirfs.MkdirAll(path)
+	})
+}
+
+func (m *ManagedDirFs) MkdirAllAbs(rootpath string, relpath string) error {
+	return m.retry(func(dirfs DirFs) error {
+		return dirfs.MkdirAllAbs(rootpath, relpath)
+	})
+}
+
+func (m *ManagedDirFs) Open(path string) (File, error) {
+	var result File
+	err := m.retry(func(dirfs DirFs) error {
+		var err error
+		result, err = dirfs.Open(path)
+		return err
+	})
+	return result, err
+}
+
+func (m *ManagedDirFs) Create(path string) (File, error) {
+	var result File
+	err := m.retry(func(dirfs DirFs) error {
+		var err error
+		result, err = dirfs.Create(path)
+		return err
+	})
+	return result, err
+}
+
+func (m *ManagedDirFs) CreateAbs(rootpath string, relpath string) (File, error) {
+	var result File
+	err := m.retry(func(dirfs DirFs) error {
+		var err error
+		result, err = dirfs.CreateAbs(rootpath, relpath)
+		return err
+	})
+	return result, err
+}
+
+func (m *ManagedDirFs) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	var result File
+	err := m.retry(func(dirfs DirFs) error {
+		var err error
+		result, err = dirfs.OpenFile(name, flag, perm)
+		return err
+	})
+	return result, err
+}
+
+func (m *ManagedDirFs) Chmod(path string, mode os.FileMode) error {
+	return m.retry(func(dirfs DirFs) error {
+		return dirfs.Chmod(path, mode)
+	})
+}
+
+func (m *ManagedDirFs) Chown(path string, uid, gid int) error {
+	return m.retry(func(dirfs DirFs) error {
+		return dirfs.Chown(path, uid, gid)
+	})
+}
+
+func (m *ManagedDirFs) Remove(path string) error {
+	return m.retry(func(dirfs DirFs) error {
+		return dirfs.Remove(path)
+	})
+}
+
+func (m *ManagedDirFs) Move(path string, destroot string) error {
+	return m.retry(func(dirfs DirFs) error {
+		return dirfs.Move(path, destroot)
+	})
+}
+
+func (m *ManagedDirFs) Rename(oldpath string, newpath string) error {
+	return m.retry(func(dirfs DirFs) error {
+		return dirfs.Rename(oldpath, newpath)
+	})
+}
+
+func (m *ManagedDirFs) Lstat(p string) (os.FileInfo, error) {
+	var result os.FileInfo
+	err := m.retry(func(dirfs DirFs) error {
+		var err error
+		result, err = dirfs.Lstat(p)
+		return err
+	})
+	return result, err
+}
+
+func (m *ManagedDirFs) uploadStreams(size int64) int {
+	dirfs, err := m.fs()
+	if err != nil {
+		return 1
+	}
+	return uploadStreams(dirfs, size)
+}
+
+var _ DirFs = (*ManagedDirFs)(nil)
+var _ chunkedUploader = (*ManagedDirFs)(nil)
+
+// openWithConnection opens a file with open, for a managed file system it also returns the file system
+// of the connection the file was opened on, so a transfer that hangs can drop its own connection.
+func openWithConnection(dirfs DirFs, open func(dirfs DirFs) (File, error)) (File, DirFs, error) {
+	m, ok := dirfs.(*ManagedDirFs)
+	if !ok {
+		file, err := open(dirfs)
+		return file, nil, err
+	}
+	var file File
+	var conn DirFs
+	err := m.retry(func(dirfs DirFs) error {
+		var err error
+		file, err = open(dirfs)
+		conn = dirfs
+		return err
+	})
+	return file, conn, err
+}
+
+// dropConnection closes the connection of a managed file system, if conn is still its current connection.
+// The next operation creates a new one.
+func dropConnection(dirfs DirFs, conn DirFs) {
+	if m, ok := dirfs.(*ManagedDirFs); ok && conn != nil {
+		m.creator.invalidate(conn)
+	}
+}
@@ -1,42 +1,56 @@
 package main
 
 import (
-	"io"
 	"io/fs"
 	iofs "io/fs"
-	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
 )
 
 type SftpDirFs struct {
 	DirFsBase
-	client *sftp.Client
+	client         *sftp.Client
+	chunkThreshold int64 // files of at least this size are uploaded in parallel byte ranges, 0 disables it
+	chunkStreams   int
 }
 
 func (fs *SftpDirFs) Walk(enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) {
-	fs.walkDir(".", 1, enterDir, enterFile, exitDir)
+	err := fs.walkDir(".", 1, enterDir, enterFile, exitDir)
+	if err != nil {
+		exitDir(".", nil, 0, err)
+	}
 }
 
-func (fs *SftpDirFs) walkDir(dir string, level int, enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) {
-	dirpath := fs.abspath(dir)
-	files, err := fs.client.ReadDir(dirpath)
+// walkDir walks the content of the directory, the error is returned if the directory can't be read.
+func (fs *SftpDirFs) walkDir(dir string, level int, enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) error {
+	files, err := fs.ReadDir(dir)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	for _, file := range files {
 		relpath := filepath.Join(dir, file.Name())
 		if file.IsDir() {
-			enterDir(relpath, iofs.FileInfoToDirEntry(file), level, nil)
-			fs.walkDir(relpath, level+1, enterDir, enterFile, exitDir)
-			exitDir(relpath, iofs.FileInfoToDirEntry(file), level, nil)
+			if enterDir(relpath, iofs.FileInfoToDirEntry(file), level, nil) == iofs.SkipDir {
+				continue
+			}
+			// an unreadable directory is reported to exitDir
+			err = fs.walkDir(relpath, level+1, enterDir, enterFile, exitDir)
+			exitDir(relpath, iofs.FileInfoToDirEntry(file), level, err)
 		} else {
 			enterFile(relpath, file, level, nil)
 		}
 	}
+	return nil
+}
+
+func (fs *SftpDirFs) ReadDir(path string) ([]os.FileInfo, error) {
+	return fs.client.ReadDir(fs.abspath(path))
 }
 
 func (fs *SftpDirFs) MkdirAll(path string) error {
@@ -59,17 +73,22 @@ func (fs *SftpDirFs) MkdirAllAbs(rootpath string, relpath string) error {
 	return nil
 }
 
-func (fs *SftpDirFs) Open(path string) (io.ReadWriteCloser, error) {
+func (fs *SftpDirFs) Open(path string) (File, error) {
 	abspath := fs.abspath(path)
 	return fs.client.Open(abspath)
 }
 
-func (fs *SftpDirFs) Create(path string) (io.ReadWriteCloser, error) {
+func (fs *SftpDirFs) Create(path string) (File, error) {
 	abspath := fs.abspath(path)
 	return fs.client.Create(abspath)
 }
 
-func (fs *SftpDirFs) OpenFile(name string, flag int, perm fs.FileMode) (io.ReadWriteCloser, error) {
+func (fs *SftpDirFs) CreateAbs(rootpath string, relpath string) (File, error) {
+	abspath := filepath.Join(rootpath, relpath)
+	return fs.client.Create(abspath)
+}
+
+func (fs *SftpDirFs) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
 	abspath := fs.abspath(name)
 	return fs.client.OpenFile(abspath, flag)
 }
@@ -95,56 +114,139 @@ func (fs *SftpDirFs) Move(path string, destroot string) error {
 	return fs.client.Rename(abspath, destpath)
 }
 
+func (fs *SftpDirFs) Rename(oldpath string, newpath string) error {
+	oldabspath := fs.abspath(oldpath)
+	newabspath := fs.abspath(newpath)
+	// the posix-rename extension replaces the new path atomically
+	err := fs.client.PosixRename(oldabspath, newabspath)
+	if err == nil {
+		return nil
+	}
+	// fallback for servers without the extension, plain sftp rename fails if the new path exists
+	_, err = fs.client.Lstat(newabspath)
+	if err == nil {
+		err = fs.client.Remove(newabspath)
+		if err != nil {
+			return err
+		}
+	}
+	return fs.client.Rename(oldabspath, newabspath)
+}
+
 func (fs *SftpDirFs) Lstat(p string) (os.FileInfo, error) {
 	abspath := fs.abspath(p)
 	return fs.client.Lstat(abspath)
 }
 
-var _ DirFs = (*SftpDirFs)(nil)
+// uploadStreams returns the number of parallel writes to the file handle, a single sftp stream is limited
+// by the window size and the latency of the connection.
+func (fs *SftpDirFs) uploadStreams(size int64) int {
+	if fs.chunkThreshold <= 0 || size < fs.chunkThreshold {
+		return 1
+	}
+	return fs.chunkStreams
+}
 
-type SftpDirFsCreator struct {
-	fs         *SftpDirFs
-	createTime time.Time
-	config     *DirFsConfig
+// withRoot returns a copy of the file system with another root folder.
+func (fs *SftpDirFs) withRoot(path string) DirFs {
+	rooted := *fs
+	rooted.Path = path
+	return &rooted
 }
 
-func (c *SftpDirFsCreator) create() (DirFs, error) {
+var _ DirFs = (*SftpDirFs)(nil)
+var _ rootedDirFs = (*SftpDirFs)(nil)
+var _ chunkedUploader = (*SftpDirFs)(nil)
+
+// SftpDirFsCreator creates a new SftpDirFs for every connection, a file system is not changed after it was created,
+// so it's safe to use it without the lock.
+type SftpDirFsCreator struct {
+	mutex     sync.Mutex
+	fs        *SftpDirFs // file system of the current connection, nil before the first connection
+	sshClient *ssh.Client
+	closed    bool
+	checkTime time.Time
+	config    *DirFsConfig
+	auth      sftpAuth
+}
+
+func (c *SftpDirFsCreator) create(job string) (DirFs, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	now := time.Now()
-	if c.fs.client == nil || c.createTime.Add(10*time.Minute).Before(now) {
-		if c.fs.client != nil {
-			log.Println("reconnect sftp client")
-			c.fs.client.Close()
-			c.fs.client = nil
+	if c.fs != nil && !c.closed && c.checkTime.Add(c.config.healthCheckInterval()).Before(now) {
+		err := c.healthCheck()
+		if err != nil {
+			jobLogf(job, "sftp connection to %s is broken, reconnect, the error is %v\n", c.config.Host, err)
+			c.closeConn()
 		}
-		var err error
-		sftpClient, err := createSftpClient(c.config)
+		c.checkTime = now
+	}
+	if c.fs == nil || c.closed {
+		sftpClient, sshClient, err := createSftpClient(c.config, &c.auth)
 		if err != nil {
 			return nil, err
 		}
-		c.createTime = time.Now()
-		c.fs.client = sftpClient
+		c.checkTime = time.Now()
+		c.fs = &SftpDirFs{
+			DirFsBase: DirFsBase{
+				Path: c.config.Path,
+			},
+			client:         sftpClient,
+			chunkThreshold: int64(c.config.ChunkThresholdMB) * 1024 * 1024,
+			chunkStreams:   c.config.chunkStreams(),
+		}
+		c.sshClient = sshClient
+		c.closed = false
 	}
 	return c.fs, nil
 }
 
+// healthCheck sends a keepalive request over the ssh connection.
+func (c *SftpDirFsCreator) healthCheck() error {
+	result := make(chan error, 1)
+	go func() {
+		// the server may reject the request, but any reply means the connection works
+		_, _, err := c.sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(connectTimeout(c.config)):
+		return errors.New("keepalive timed out")
+	}
+}
+
+// close closes the connection, the file systems that use it fail until they are created again.
 func (c *SftpDirFsCreator) close() {
-	if c.fs != nil {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closeConn()
+}
+
+func (c *SftpDirFsCreator) invalidate(dirfs DirFs) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// a file system with another root folder shares the client of its connection
+	if fs, ok := dirfs.(*SftpDirFs); ok && c.fs != nil && fs.client == c.fs.client {
+		c.closeConn()
+	}
+}
+
+func (c *SftpDirFsCreator) closeConn() {
+	if c.fs != nil && !c.closed {
 		c.fs.client.Close()
+		c.sshClient.Close()
+		c.closed = true
 	}
 }
 
 var _ DirFsCreator = (*SftpDirFsCreator)(nil)
 
 func createSftpDirFsCreator(config DirFsConfig) (DirFsCreator, error) {
-	fs := SftpDirFs{
-		DirFsBase: DirFsBase{
-			Path: config.Path,
-		},
-	}
 	return &SftpDirFsCreator{
-		fs:         &fs,
-		createTime: time.Now(),
-		config:     &config,
+		config: &config,
 	}, nil
 }
 
@@ -2,16 +2,16 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"io/fs"
 	iofs "io/fs"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/hirochachacha/go-smb2"
+	"github.com/pkg/errors"
 )
 
 type SmbDirFs struct {
@@ -22,25 +22,36 @@ type SmbDirFs struct {
 }
 
 func (fs *SmbDirFs) Walk(enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) {
-	fs.walkDir(".", 1, enterDir, enterFile, exitDir)
+	err := fs.walkDir(".", 1, enterDir, enterFile, exitDir)
+	if err != nil {
+		exitDir(".", nil, 0, err)
+	}
 }
 
-func (fs *SmbDirFs) walkDir(dir string, level int, enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) {
-	dirpath := fs.abspath(dir)
-	files, err := fs.share.ReadDir(dirpath)
+// walkDir walks the content of the directory, the error is returned if the directory can't be read.
+func (fs *SmbDirFs) walkDir(dir string, level int, enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc) error {
+	files, err := fs.ReadDir(dir)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	for _, file := range files {
 		relpath := filepath.Join(dir, file.Name())
 		if file.IsDir() {
-			enterDir(relpath, iofs.FileInfoToDirEntry(file), level, nil)
-			fs.walkDir(relpath, level+1, enterDir, enterFile, exitDir)
-			exitDir(relpath, iofs.FileInfoToDirEntry(file), level, nil)
+			if enterDir(relpath, iofs.FileInfoToDirEntry(file), level, nil) == iofs.SkipDir {
+				continue
+			}
+			// an unreadable directory is reported to exitDir
+			err = fs.walkDir(relpath, level+1, enterDir, enterFile, exitDir)
+			exitDir(relpath, iofs.FileInfoToDirEntry(file), level, err)
 		} else {
 			enterFile(relpath, file, level, nil)
 		}
 	}
+	return nil
+}
+
+func (fs *SmbDirFs) ReadDir(path string) ([]os.FileInfo, error) {
+	return fs.share.ReadDir(fs.abspath(path))
 }
 
 func (fs *SmbDirFs) MkdirAll(path string) error {
@@ -58,17 +69,22 @@ func (fs *SmbDirFs) MkdirAllAbs(rootpath string, relpath string) error {
 	return fs.share.MkdirAll(abspath, DirFileMode)
 }
 
-func (fs *SmbDirFs) Open(path string) (io.ReadWriteCloser, error) {
+func (fs *SmbDirFs) Open(path string) (File, error) {
 	abspath := fs.abspath(path)
 	return fs.share.Open(abspath)
 }
 
-func (fs *SmbDirFs) Create(path string) (io.ReadWriteCloser, error) {
+func (fs *SmbDirFs) Create(path string) (File, error) {
 	abspath := fs.abspath(path)
 	return fs.share.Create(abspath)
 }
 
-func (fs *SmbDirFs) OpenFile(name string, flag int, perm fs.FileMode) (io.ReadWriteCloser, error) {
+func (fs *SmbDirFs) CreateAbs(rootpath string, relpath string) (File, error) {
+	abspath := filepath.Join(rootpath, relpath)
+	return fs.share.Create(abspath)
+}
+
+func (fs *SmbDirFs) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
 	abspath := fs.abspath(name)
 	return fs.share.OpenFile(abspath, flag, perm)
 }
@@ -94,31 +110,65 @@ func (fs *SmbDirFs) Move(path string, destroot string) error {
 	return fs.share.Rename(abspath, destpath)
 }
 
+func (fs *SmbDirFs) Rename(oldpath string, newpath string) error {
+	oldabspath := fs.abspath(oldpath)
+	newabspath := fs.abspath(newpath)
+	// smb rename doesn't replace an existing file
+	_, err := fs.share.Lstat(newabspath)
+	if err == nil {
+		err = fs.share.Remove(newabspath)
+		if err != nil {
+			return err
+		}
+	}
+	return fs.share.Rename(oldabspath, newabspath)
+}
+
 func (fs *SmbDirFs) Lstat(p string) (os.FileInfo, error) {
 	abspath := fs.abspath(p)
 	return fs.share.Lstat(abspath)
 }
 
+// withRoot returns a copy of the file system with another root folder.
+func (fs *SmbDirFs) withRoot(path string) DirFs {
+	rooted := *fs
+	rooted.Path = path
+	return &rooted
+}
+
 var _ DirFs = (*SmbDirFs)(nil)
+var _ rootedDirFs = (*SmbDirFs)(nil)
 
+// SmbDirFsCreator creates a new SmbDirFs for every connection, a file system is not changed after it was created,
+// so it's safe to use it without the lock.
 type SmbDirFsCreator struct {
-	fs         *SmbDirFs
-	createTime time.Time
-	config     *DirFsConfig
+	mutex     sync.Mutex
+	fs        *SmbDirFs // file system of the current connection, nil before the first connection
+	closed    bool
+	checkTime time.Time
+	config    *DirFsConfig
 }
 
-func (c *SmbDirFsCreator) create() (DirFs, error) {
+func (c *SmbDirFsCreator) create(job string) (DirFs, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	now := time.Now()
-	if c.fs.session == nil || c.createTime.Add(10*time.Minute).Before(now) {
-		if c.fs.session != nil {
-			log.Println("reconnect smb client")
-			c.close()
+	if c.fs != nil && !c.closed && c.checkTime.Add(c.config.healthCheckInterval()).Before(now) {
+		err := c.healthCheck()
+		if err != nil {
+			jobLogf(job, "smb connection to %s is broken, reconnect, the error is %v\n", c.config.Host, err)
+			c.closeConn()
 		}
-		var err error
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", c.config.Host, c.config.Port))
+		c.checkTime = now
+	}
+	if c.fs == nil || c.closed {
+		timeout := connectTimeout(c.config)
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(c.config.Host, fmt.Sprint(c.config.Port)), timeout)
 		if err != nil {
-			panic(err)
+			return nil, errors.Wrap(err, "can't connect to smb server")
 		}
+		// the session setup must not hang on a broken connection
+		conn.SetDeadline(time.Now().Add(timeout))
 
 		d := &smb2.Dialer{
 			Initiator: &smb2.NTLMInitiator{
@@ -130,46 +180,75 @@ func (c *SmbDirFsCreator) create() (DirFs, error) {
 
 		session, err := d.Dial(conn)
 		if err != nil {
-			panic(err)
+			conn.Close()
+			return nil, errors.Wrap(err, "can't create smb session")
 		}
 
 		share, err := session.Mount(c.config.ShareName)
 		if err != nil {
-			panic(err)
+			session.Logoff()
+			conn.Close()
+			return nil, errors.Wrap(err, "can't mount smb share")
 		}
+		conn.SetDeadline(time.Time{})
 
-		c.createTime = time.Now()
-		c.fs.conn = &conn
-		c.fs.session = session
-		c.fs.share = share
+		c.checkTime = time.Now()
+		c.fs = &SmbDirFs{
+			DirFsBase: DirFsBase{
+				Path: c.config.Path,
+			},
+			conn:    &conn,
+			session: session,
+			share:   share,
+		}
+		c.closed = false
 	}
 	return c.fs, nil
 }
 
+// healthCheck stats the root folder on the share, only connection errors are reported.
+func (c *SmbDirFsCreator) healthCheck() error {
+	conn := *c.fs.conn
+	conn.SetDeadline(time.Now().Add(connectTimeout(c.config)))
+	defer conn.SetDeadline(time.Time{})
+	_, err := c.fs.share.Stat(c.fs.Path)
+	if isConnectionError(err) {
+		return err
+	}
+	return nil
+}
+
+// close closes the connection, the file systems that use it fail until they are created again.
 func (c *SmbDirFsCreator) close() {
-	if c.fs != nil {
-		if c.fs.share != nil {
-			c.fs.session.Logoff()
-			(*c.fs.conn).Close()
-			c.fs.share = nil
-			c.fs.session = nil
-			c.fs.conn = nil
-		}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closeConn()
+}
+
+func (c *SmbDirFsCreator) invalidate(dirfs DirFs) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// a file system with another root folder shares the session of its connection
+	if fs, ok := dirfs.(*SmbDirFs); ok && c.fs != nil && fs.session == c.fs.session {
+		c.closeConn()
 	}
 }
 
-var _ DirFsCreator = (*SftpDirFsCreator)(nil)
+func (c *SmbDirFsCreator) closeConn() {
+	if c.fs != nil && !c.closed {
+		// logoff must not hang if the connection is broken
+		(*c.fs.conn).SetDeadline(time.Now().Add(connectTimeout(c.config)))
+		c.fs.session.Logoff()
+		(*c.fs.conn).Close()
+		c.closed = true
+	}
+}
+
+var _ DirFsCreator = (*SmbDirFsCreator)(nil)
 
 func createSmbDirFsCreator(config DirFsConfig) (DirFsCreator, error) {
-	fs := SmbDirFs{
-		DirFsBase: DirFsBase{
-			Path: config.Path,
-		},
-	}
 	return &SmbDirFsCreator{
-		fs:         &fs,
-		createTime: time.Now(),
-		config:     &config,
+		config: &config,
 	}, nil
 }
 
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// actions of the transfer plan
+const (
+	planTransfer  = "transfer"   // transfer the file and move it to the dustbin
+	planResume    = "resume"     // resume the unfinished transfer and move the file to the dustbin
+	planRemove    = "remove"     // remove the source file without transferring it
+	planDustbin   = "dustbin"    // move the source file to the dustbin without transferring it
+	planSkip      = "skip"       // leave the file or folder for a later scan
+	planRemoveDir = "remove-dir" // remove the empty source folder
+	planPublish   = "publish"    // move the staged dataset to its final place
+	planPurge     = "purge"      // remove the verified file from the dustbin after the retention period
+)
+
+// PlannedAction is an action the file move would take.
+type PlannedAction struct {
+	Job     string `json:"job,omitempty"` // name of the job
+	Action  string `json:"action"`
+	Dest    string `json:"dest,omitempty"`    // name of the destination, if the job has several destinations
+	Path    string `json:"path"`              // source path, the path in the dustbin for a purge
+	Target  string `json:"target,omitempty"`  // destination path
+	Dustbin string `json:"dustbin,omitempty"` // path of the source file in the dustbin
+	After   string `json:"after,omitempty"`   // what happens to the source file after the transfer, if it's not moved to the dustbin
+	Reason  string `json:"reason,omitempty"`  // why the file or folder is skipped
+}
+
+// planFileMove walks the source with the same rules as FileMove, and returns the actions it would take.
+// Nothing is written on the source or the destination.
+func planFileMove(source DirFs, dests []*destination, dustbin string, config ExecutionConfig, state *TransferState) ([]PlannedAction, error) {
+	filters, err := config.filters()
+	if err != nil {
+		return nil, err
+	}
+	var plan []PlannedAction
+	// folders that keep some content after the move, they are not removed
+	keep := make(map[string]bool)
+	skip := func(path string, reason string) {
+		plan = append(plan, PlannedAction{Action: planSkip, Path: path, Reason: reason})
+		keep[filepath.Dir(path)] = true
+	}
+	var walkErr error
+	source.Walk(func(path string, d fs.DirEntry, level int, err error) error {
+		if config.trackDatasets() && level == config.StartLevel && !state.enterDataset(source, path, config) {
+			skip(path, "dataset is not complete")
+			return fs.SkipDir
+		}
+		return nil
+	}, func(path string, info fs.FileInfo, level int, err error) error {
+		if level < config.StartLevel {
+			keep[filepath.Dir(path)] = true
+			return nil
+		}
+		if config.trackDatasets() && isDatasetMarker(path, config) {
+			// the marker is handled after the rest of the dataset
+			return nil
+		}
+		if config.transferredBefore(path, info, state) {
+			keep[filepath.Dir(path)] = true
+			return nil
+		}
+		if filter := filterFile(filters, path, info); filter != nil {
+			switch filter.rule.Action {
+			case filterDelete:
+				plan = append(plan, PlannedAction{Action: planRemove, Path: path})
+			case filterDustbin:
+				plan = append(plan, PlannedAction{Action: planDustbin, Path: path, Dustbin: filepath.Join(dustbin, path)})
+			default:
+				skip(path, "excluded by filter "+filter.rule.Pattern)
+			}
+			return nil
+		}
+		if state.inBackoff(path) {
+			skip(path, "transfer failed recently")
+			return nil
+		}
+		if !state.isStable(path, info, config) {
+			skip(path, "file is not stable yet")
+			return nil
+		}
+		for _, dest := range dests {
+			if len(dests) > 1 && state.copied(path, info, dest.name) {
+				continue
+			}
+			targetPath, resumed, err := targetPathOf(dest, path, info, config, state)
+			if err != nil {
+				skip(path, err.Error())
+				return nil
+			}
+			action := planTransfer
+			if resumed {
+				action = planResume
+			}
+			dustbinPath, after := sourceAfterTransfer(source, dustbin, path, config)
+			plan = append(plan, PlannedAction{
+				Action:  action,
+				Dest:    dest.name,
+				Path:    path,
+				Target:  filepath.Join(dest.root, targetPath),
+				Dustbin: dustbinPath,
+				After:   after,
+			})
+		}
+		return nil
+	}, func(path string, d fs.DirEntry, level int, err error) error {
+		if level == 0 {
+			walkErr = err
+			return err
+		}
+		if err != nil {
+			skip(path, "can't read folder: "+err.Error())
+			return nil
+		}
+		if config.trackDatasets() && level == config.StartLevel {
+			if keep[path] {
+				// some files of the dataset are skipped
+				keep[filepath.Dir(path)] = true
+				return nil
+			}
+			planCompleteDataset(source, dests, dustbin, path, config, state, &plan)
+		}
+		if level >= config.StartLevel && !keep[path] && config.removesSource() {
+			plan = append(plan, PlannedAction{Action: planRemoveDir, Path: path})
+		} else {
+			keep[filepath.Dir(path)] = true
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, errors.Wrap(walkErr, "can't read source folder")
+	}
+	return plan, nil
+}
+
+// planCompleteDataset adds the actions of completeDataset.
+func planCompleteDataset(source DirFs, dests []*destination, dustbin string, path string, config ExecutionConfig, state *TransferState, plan *[]PlannedAction) {
+	if config.DatasetMarker != "" {
+		markerPath := filepath.Join(path, config.DatasetMarker)
+		if info, err := source.Lstat(markerPath); err == nil && !config.transferredBefore(markerPath, info, state) {
+			if config.MarkerToDest {
+				dustbinPath, after := sourceAfterTransfer(source, dustbin, markerPath, config)
+				for _, dest := range dests {
+					*plan = append(*plan, PlannedAction{
+						Action:  planTransfer,
+						Dest:    dest.name,
+						Path:    markerPath,
+						Target:  filepath.Join(dest.root, stagingPath(markerPath, path, config)),
+						Dustbin: dustbinPath,
+						After:   after,
+					})
+				}
+			} else if config.afterTransfer() != afterKeep {
+				*plan = append(*plan, PlannedAction{Action: planRemove, Path: markerPath})
+			}
+		}
+	}
+	if config.stagingMode() {
+		for _, dest := range dests {
+			*plan = append(*plan, PlannedAction{
+				Action: planPublish,
+				Dest:   dest.name,
+				Path:   filepath.Join(dest.root, stagingPath(path, path, config)),
+				Target: filepath.Join(dest.root, path),
+			})
+		}
+	}
+}
+
+// printPlan writes the plan as text, one action per line, or as json.
+func printPlan(out io.Writer, plan []PlannedAction, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if plan == nil {
+			plan = []PlannedAction{}
+		}
+		return encoder.Encode(plan)
+	}
+	for _, action := range plan {
+		line := fmt.Sprintf("%-10s %s", action.Action, action.Path)
+		if action.Job != "" {
+			line = "[" + action.Job + "] " + line
+		}
+		if action.Target != "" {
+			line += " -> " + action.Target
+			if action.Dest != "" {
+				line += " on " + action.Dest
+			}
+		}
+		if action.Dustbin != "" {
+			line += ", source to " + action.Dustbin
+		}
+		if action.After != "" {
+			line += ", source " + action.After
+		}
+		if action.Reason != "" {
+			line += " (" + action.Reason + ")"
+		}
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DryRun prints the actions the next scan of every job would take, without writing, moving or deleting anything.
+func DryRun(config *AppConfig, format string, out io.Writer) error {
+	if format != "text" && format != "json" {
+		return errors.Errorf("unsupported output format: %s", format)
+	}
+	pool := newConnectionPool()
+	var plan []PlannedAction
+	for _, job := range config.Jobs {
+		jobPlan, err := planJob(job, pool)
+		if err != nil {
+			if job.Name != "" {
+				return errors.Wrapf(err, "job %s", job.Name)
+			}
+			return err
+		}
+		for i := range jobPlan {
+			jobPlan[i].Job = job.Name
+		}
+		plan = append(plan, jobPlan...)
+	}
+	return printPlan(out, plan, format)
+}
+
+// planJob returns the actions the next scan of the job would take.
+func planJob(config JobConfig, pool *connectionPool) ([]PlannedAction, error) {
+	sourceFsCreator, err := pool.acquire(config.Source)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create source fs creator")
+	}
+	defer pool.release(config.Source)
+	var dests []*destination
+	defer func() {
+		releaseDestinations(config.Dests[:len(dests)], pool)
+	}()
+	for _, destConfig := range config.Dests {
+		dest, err := acquireDestination(destConfig, pool, config.Name)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, dest)
+	}
+	// the state is only read, it's not saved
+	state, err := loadJobState(config)
+	if err != nil {
+		return nil, err
+	}
+	sourceFs := newManagedDirFs(sourceFsCreator, config.Source, config.Name)
+	if _, err = sourceFs.fs(); err != nil {
+		return nil, errors.Wrap(err, "can't create source fs")
+	}
+	// an optional destination that is not available is left out, like in the transfer
+	var available []*destination
+	for _, dest := range dests {
+		err = dest.available()
+		if err == nil {
+			available = append(available, dest)
+		} else if !dest.optional {
+			return nil, errors.Wrapf(err, "can't create fs of the %s", dest.label())
+		}
+	}
+	plan, err := planFileMove(sourceFs, available, config.Dustbin, config.Execution, state)
+	if err != nil || !config.Execution.Retention.enabled() {
+		return plan, err
+	}
+	dustbinCreator, err := pool.acquire(config.dustbinConfig())
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create dustbin fs creator")
+	}
+	defer pool.release(config.dustbinConfig())
+	dustbinFs := newManagedDirFs(dustbinCreator, config.dustbinConfig(), config.Name)
+	return append(plan, planDustbinPurge(dustbinFs, dests, config.Dustbin, config.Execution.Retention, state)...), nil
+}
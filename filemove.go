@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/fs"
@@ -8,7 +9,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 type FsType string
@@ -21,28 +26,51 @@ const (
 const DirFileMode = os.FileMode(int(0770))
 const FileFileMode = os.FileMode(int(0660))
 
+// errFileNotReady is returned for files that are skipped in this cycle and will be transferred later
+var errFileNotReady = errors.New("file is not ready for transfer")
+
+// suffix of the hidden file a transfer writes to before it's renamed to the final name
+const PartialFileSuffix = ".tohpc-partial"
+
 type WalkFunc func(path string, info fs.FileInfo, level int, err error) error
 
+// WalkDirFunc is called when the walk enters or exits a directory,
+// if enterDir returns fs.SkipDir, the content of the directory is skipped.
+// If the directory can't be read, the error is passed to exitDir, "." is passed for the root directory.
 type WalkDirFunc func(path string, d fs.DirEntry, level int, err error) error
 
+// File is a file opened on a DirFs, it's seekable so interrupted transfers can be resumed.
+type File interface {
+	io.ReadWriteSeeker
+	io.Closer
+}
+
 type DirFs interface {
 	Walk(enterDir WalkDirFunc, enterFile WalkFunc, exitDir WalkDirFunc)
+	ReadDir(path string) ([]os.FileInfo, error)
 	MkdirAll(path string) error
 	MkdirAllAbs(rootpath string, relpath string) error
-	Open(path string) (io.ReadWriteCloser, error)
-	Create(path string) (io.ReadWriteCloser, error)
-	OpenFile(name string, flag int, perm fs.FileMode) (io.ReadWriteCloser, error)
+	Open(path string) (File, error)
+	Create(path string) (File, error)
+	CreateAbs(rootpath string, relpath string) (File, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
 	Chmod(path string, mode os.FileMode) error
 	Chown(path string, uid, gid int) error
 	// remove file or (empty) dir
 	Remove(path string) error
 	Move(path string, destroot string) error
+	// rename file, replace the new path if it exists
+	Rename(oldpath string, newpath string) error
 	Lstat(p string) (os.FileInfo, error)
 }
 
 type DirFsCreator interface {
-	create() (DirFs, error)
+	// create returns the file system of the current connection, the connection problems are logged for the job
+	create(job string) (DirFs, error)
 	close()
+	// invalidate closes the connection of the file system, if it's still the current connection.
+	// A connection that was already replaced is left alone, so a failed operation doesn't close the new one.
+	invalidate(dirfs DirFs)
 }
 
 var fsCreatorMap = make(map[string]func(config DirFsConfig) (DirFsCreator, error))
@@ -54,7 +82,7 @@ func registCreatorFactory(typev string, create func(config DirFsConfig) (DirFsCr
 func CreateFsCreator(config DirFsConfig) (DirFsCreator, error) {
 	creatorFactory, ok := fsCreatorMap[string(config.Type)]
 	if !ok {
-		return nil, nil
+		return nil, errors.Errorf("unsupported file system type: %s", config.Type)
 	}
 	creator, err := creatorFactory(config)
 	if err != nil {
@@ -63,126 +91,905 @@ func CreateFsCreator(config DirFsConfig) (DirFsCreator, error) {
 	return creator, nil
 }
 
-func KeepFileMove(config *AppConfig) {
-	sourceFsCreator, err := CreateFsCreator(config.Source)
+// moveJob holds the file systems and the state of the transfers of a job from the source to the destination.
+type moveJob struct {
+	config   JobConfig
+	pool     *connectionPool
+	sourceFs *ManagedDirFs
+	dests    []*destination // the file systems of the destinations are managed
+	state    *TransferState
+}
+
+// newMoveJob acquires the connections of the job from the pool, bandwidth is the global limit of all jobs.
+func newMoveJob(config JobConfig, bandwidth *tokenBucket, pool *connectionPool) (*moveJob, error) {
+	if len(config.Dests) == 0 {
+		return nil, errors.New("the job has no destination")
+	}
+	state, err := loadJobState(config)
 	if err != nil {
-		log.Printf("can't create source fs creator, the error is %v\n", err)
-		return
+		return nil, err
 	}
-	destFsCreator, err := CreateFsCreator(config.Dest)
+	if err = state.compactJournals(); err != nil {
+		state.logf("%v\n", err)
+	}
+	sourceFsCreator, err := pool.acquire(config.Source)
 	if err != nil {
-		log.Printf("can't create dest fs creator, the error is %v\n", err)
-		return
+		return nil, errors.Wrap(err, "can't create source fs creator")
+	}
+	var dests []*destination
+	for i, destConfig := range config.Dests {
+		dest, err := acquireDestination(destConfig, pool, config.Name)
+		if err != nil {
+			pool.release(config.Source)
+			releaseDestinations(config.Dests[:i], pool)
+			return nil, err
+		}
+		dests = append(dests, dest)
 	}
-	for {
-		log.Printf("execute file move\n")
-		oneFileMove(sourceFsCreator, destFsCreator, config.Dustbin, config.Execution)
-		log.Printf("move finished\n")
-		time.Sleep(5 * time.Second)
+	state.setBandwidth(bandwidth, newTokenBucket(config.Execution.Bandwidth))
+	// the file systems are managed, so a connection that was dropped is created again
+	job := &moveJob{
+		config:   config,
+		pool:     pool,
+		sourceFs: newManagedDirFs(sourceFsCreator, config.Source, config.Name),
+		dests:    dests,
+		state:    state,
 	}
+	for _, dest := range dests {
+		cleanDestination(dest, state)
+	}
+	return job, nil
 }
 
-func oneFileMove(sourceFsCreator DirFsCreator, destFsCreator DirFsCreator, dustbin string, config ExecutionConfig) {
-	sourceFs, err := sourceFsCreator.create()
+// acquireDestination acquires the connection of the destination from the pool.
+func acquireDestination(config DestinationConfig, pool *connectionPool, job string) (*destination, error) {
+	creator, err := pool.acquire(config.DirFsConfig)
 	if err != nil {
-		log.Printf("can't create source fs, the error is %v\n", err)
+		return nil, errors.Wrap(err, "can't create dest fs creator")
+	}
+	return &destination{
+		DirFs:    newManagedDirFs(creator, config.DirFsConfig, job),
+		name:     config.Name,
+		root:     config.Path,
+		optional: config.Optional,
+	}, nil
+}
+
+// releaseDestinations releases the connections of the destinations.
+func releaseDestinations(dests []DestinationConfig, pool *connectionPool) {
+	for _, dest := range dests {
+		pool.release(dest.DirFsConfig)
+	}
+}
+
+// cleanDestination removes the partial files that can't be resumed from the destination, if it's available.
+func cleanDestination(dest *destination, state *TransferState) {
+	if dest.available() == nil {
+		cleanPartialFiles(dest, state)
+	}
+}
+
+// run scans the source once and transfers the files that are ready.
+func (j *moveJob) run(ctx context.Context) (MoveResult, error) {
+	j.state.logf("execute file move\n")
+	result, err := oneFileMove(ctx, j.sourceFs, j.dests, j.config.Dustbin, j.config.Quarantine, j.config.Execution, j.state)
+	j.state.logf("move finished\n")
+	return result, err
+}
+
+// close releases the connections of the source and the destinations, they are closed if no other job uses them.
+func (j *moveJob) close() {
+	j.pool.release(j.config.Source)
+	releaseDestinations(j.config.Dests, j.pool)
+}
+
+// keep scans the source and transfers the files until the context is canceled.
+// A reloaded config from updates is applied between two scans.
+func (j *moveJob) keep(ctx context.Context, updates *mailbox, status *jobStatus) {
+	watcher := createChangeWatcher(j.config.Source, j.state)
+	defer func() {
+		if watcher != nil {
+			watcher.close()
+		}
+	}()
+	moveActivity.setWaiting(false)
+	defer moveActivity.setWaiting(true)
+	var purger dustbinPurger
+	defer purger.wait()
+	for ctx.Err() == nil {
+		if update, ok := updates.take().(jobUpdate); ok {
+			sourceChanged := update.config.Source != j.config.Source
+			err := j.reconfigure(update.config, update.bandwidth)
+			if err != nil {
+				j.state.logf("can't apply reloaded config, keep the current config, the error is %v\n", err)
+			} else if sourceChanged {
+				if watcher != nil {
+					watcher.close()
+				}
+				watcher = createChangeWatcher(j.config.Source, j.state)
+			}
+		}
+		// the waits are interrupted by a reloaded config
+		waitCtx, cancel := updates.waitContext(ctx)
+		moveActivity.setWaiting(true)
+		open := j.config.Execution.Windows.waitForWindow(waitCtx, j.state)
+		moveActivity.setWaiting(false)
+		cancel()
+		if !open {
+			continue
+		}
+		status.set(j.config.Name, "scanning the source")
+		result, err := j.run(ctx)
+		if err != nil {
+			status.set(j.config.Name, "source or destination not available: "+err.Error())
+		} else {
+			status.set(j.config.Name, fmt.Sprintf("last scan at %s: %d files transferred, %d failed, %d pending",
+				time.Now().Format("15:04:05"), result.Transferred, result.Failed, result.Pending))
+		}
+		purger.start(ctx, j.config, j.pool, j.state)
+		waitCtx, cancel = updates.waitContext(ctx)
+		moveActivity.setWaiting(true)
+		waitForNextScan(waitCtx, watcher, j.config, j.state)
+		moveActivity.setWaiting(false)
+		cancel()
+	}
+	if j.config.Name != "" {
+		j.state.logf("job stopped\n")
+	}
+}
+
+// KeepFileMove runs the jobs concurrently until the context is canceled. A job that can't be started
+// doesn't stop the other jobs. A config from the reloader is applied between two scans, the reloader may be nil.
+func KeepFileMove(ctx context.Context, config *AppConfig, reloader *configReloader) {
+	pool := newConnectionPool()
+	bandwidth := newTokenBucket(config.Bandwidth)
+	status := newJobStatus(config.Jobs)
+	jobs := make(map[string]*mailbox)
+	var wg sync.WaitGroup
+	for _, jobConfig := range config.Jobs {
+		job, err := newMoveJob(jobConfig, bandwidth, pool)
+		if err != nil {
+			jobLogf(jobConfig.Name, "%v\n", err)
+			continue
+		}
+		updates := newMailbox()
+		jobs[jobConfig.Name] = updates
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer job.close()
+			job.keep(ctx, updates, status)
+		}()
+	}
+	if len(jobs) == 0 {
 		return
 	}
-	destFs, err := destFsCreator.create()
+	sdNotify("READY=1")
+	dispatchReloads(ctx, reloader, jobs)
+	wg.Wait()
+	log.Printf("file move stopped\n")
+}
+
+// exit codes of the single pass mode
+const (
+	exitTransferred = 0 // every file that was ready is transferred
+	exitFailed      = 1 // some files failed, or the source or the destination is not available
+	exitNothing     = 2 // the source has no file to transfer
+	exitPending     = 3 // no file was ready for transfer, but some files wait to become ready
+)
+
+// FileMoveOnce runs every job once concurrently and closes the connections.
+// It returns the exit code of the program, a failed job makes the program fail.
+func FileMoveOnce(ctx context.Context, config *AppConfig) int {
+	for _, jobConfig := range config.Jobs {
+		if jobConfig.Execution.waitsForScans() {
+			// the stability is only tracked while the program runs, a single pass never sees a file as stable
+			jobLogf(jobConfig.Name, "stable-scans, stable-seconds and dataset-idle-seconds can't be used with -once, use a dataset-marker instead\n")
+			return exitFailed
+		}
+	}
+	pool := newConnectionPool()
+	bandwidth := newTokenBucket(config.Bandwidth)
+	codes := make([]int, len(config.Jobs))
+	var wg sync.WaitGroup
+	for i, jobConfig := range config.Jobs {
+		wg.Add(1)
+		go func(i int, jobConfig JobConfig) {
+			defer wg.Done()
+			codes[i] = moveJobOnce(ctx, jobConfig, bandwidth, pool)
+		}(i, jobConfig)
+	}
+	wg.Wait()
+	code := exitNothing
+	for _, jobCode := range codes {
+		switch {
+		case jobCode == exitFailed:
+			return exitFailed
+		case jobCode == exitTransferred:
+			code = exitTransferred
+		case jobCode == exitPending && code == exitNothing:
+			code = exitPending
+		}
+	}
+	return code
+}
+
+// moveJobOnce scans the source of the job once and transfers the files that are ready, it returns the exit code of the job.
+func moveJobOnce(ctx context.Context, config JobConfig, bandwidth *tokenBucket, pool *connectionPool) int {
+	job, err := newMoveJob(config, bandwidth, pool)
 	if err != nil {
-		log.Printf("can't create dest fs, the error is %v\n", err)
-		return
+		jobLogf(config.Name, "%v\n", err)
+		return exitFailed
+	}
+	defer job.close()
+	if !config.Execution.Windows.open(time.Now()) {
+		job.state.logf("outside of the transfer windows, nothing is transferred\n")
+		return exitNothing
+	}
+	result, err := job.run(ctx)
+	if err != nil {
+		return exitFailed
+	}
+	job.state.logf("%d files transferred, %d failed, %d pending\n", result.Transferred, result.Failed, result.Pending)
+	if config.Execution.Retention.enabled() {
+		purgeJobDustbin(ctx, config, pool, job.state)
 	}
-	FileMove(sourceFs, destFs, dustbin, config)
-	log.Printf("finished\n")
+	if result.Failed > 0 {
+		return exitFailed
+	}
+	if result.Transferred > 0 {
+		return exitTransferred
+	}
+	if result.Pending > 0 {
+		return exitPending
+	}
+	return exitNothing
+}
+
+func oneFileMove(ctx context.Context, sourceFs *ManagedDirFs, dests []*destination, dustbin string, quarantine string, config ExecutionConfig, state *TransferState) (MoveResult, error) {
+	_, err := sourceFs.fs()
+	if err != nil {
+		state.logf("can't create source fs, the error is %v\n", err)
+		return MoveResult{}, err
+	}
+	// an optional destination that is not available is left out of this scan
+	var available []*destination
+	for _, dest := range dests {
+		err = dest.available()
+		if err == nil {
+			available = append(available, dest)
+		} else if dest.optional {
+			state.logf("can't create fs of the optional %s, it's skipped, the error is %v\n", dest.label(), err)
+		} else {
+			state.logf("can't create dest fs, the error is %v\n", err)
+			return MoveResult{}, err
+		}
+	}
+	result := FileMove(ctx, sourceFs, available, dustbin, quarantine, config, state)
+	state.logf("finished\n")
+	return result, nil
+}
+
+// MoveResult counts the files of one scan of the source.
+type MoveResult struct {
+	Transferred int64 // files that were transferred
+	Failed      int64 // files and folders that failed
+	Pending     int64 // files that are not ready and are left for a later scan
+}
+
+// add counts the result of a file, it's called by the workers.
+func (r *MoveResult) add(err error) {
+	moveActivity.touch()
+	switch {
+	case err == nil:
+		atomic.AddInt64(&r.Transferred, 1)
+	case err == errFileNotReady:
+		atomic.AddInt64(&r.Pending, 1)
+	default:
+		atomic.AddInt64(&r.Failed, 1)
+	}
+}
+
+func (r *MoveResult) fail() {
+	atomic.AddInt64(&r.Failed, 1)
 }
 
-func FileMove(source DirFs, dest DirFs, dustbin string, config ExecutionConfig) {
+func FileMove(ctx context.Context, source DirFs, dests []*destination, dustbin string, quarantine string, config ExecutionConfig, state *TransferState) MoveResult {
+	state.beginScan()
+	defer state.endScan()
+	var result MoveResult
+	// after ctx is canceled no new transfers are started, the running transfers are aborted after the grace period
+	transferCtx, abortTransfers := context.WithCancel(context.Background())
+	defer abortTransfers()
+	go func() {
+		select {
+		case <-ctx.Done():
+			state.logf("stopping, wait up to %s for the running transfers\n", config.shutdownGrace())
+			select {
+			case <-time.After(config.shutdownGrace()):
+				abortTransfers()
+			case <-transferCtx.Done():
+			}
+		case <-transferCtx.Done():
+		}
+	}()
+	filters, err := config.filters()
+	if err != nil {
+		state.logf("can't compile the filters, the error is %v\n", err)
+		result.fail()
+		return result
+	}
+	// the records of the files that were removed from the source are forgotten after the scan
+	listing := newSourceListing()
+	sourceRead := true
+	// files are transferred by the workers, a folder is exited after all its files are done
+	pool := newWorkerPool(config.workers())
 	source.Walk(func(path string, d fs.DirEntry, level int, err error) error {
-		// make dir for destination and dustbin
-		if err != nil {
-			return err
+		moveActivity.touch()
+		listing.seen[path] = true
+		if ctx.Err() != nil {
+			// the program is stopping, the folder is handled in the next run
+			if config.trackDatasets() && level >= config.StartLevel {
+				state.datasetIncomplete(datasetOfDir(path, level, config.StartLevel))
+			}
+			return fs.SkipDir
 		}
-		err = dest.MkdirAll(path)
-		if err != nil {
-			log.Printf("can't create parent folders on destination for folder %s,\nthe error is: %v\n", path, err)
-			return err
+		err = enterSourceDir(source, dests, dustbin, path, level, config, state)
+		if err != fs.SkipDir {
+			pool.enterDir()
+		} else if config.trackDatasets() && level == config.StartLevel {
+			// the dataset is not complete yet
+			result.add(errFileNotReady)
 		}
-		dest.Chown(path, config.Uid, config.Gid)
-		err = source.MkdirAllAbs(dustbin, path)
-		if err != nil {
-			log.Printf("can't create parent folders on dustbin for folder %s,\nthe error is: %v\n", path, err)
-			return err
+		if err != nil && err != fs.SkipDir {
+			result.fail()
 		}
-		return nil
+		return err
 	}, func(path string, info fs.FileInfo, level int, err error) error {
-		// copy file to the destination, and move source file to the dustbin
+		// copy file to the destination, and handle the source file as the after-transfer policy says
+		listing.seen[path] = true
 		if level < config.StartLevel {
 			return nil
 		}
-		if strings.HasPrefix(filepath.Base(path), ".DS_Store") {
-			source.Remove(path)
+		if config.trackDatasets() {
+			if !state.datasetReady(path, info, config) {
+				result.add(errFileNotReady)
+				return nil
+			}
+			// the marker is handled after the rest of the dataset
+			if isDatasetMarker(path, config) {
+				return nil
+			}
+		}
+		if config.transferredBefore(path, info, state) {
+			return nil
+		}
+		if filter := filterFile(filters, path, info); filter != nil {
+			applyFilter(source, dustbin, path, filter, state)
 			return nil
 		}
-		targetPath := path
-
-		// rename target file if needed
-		if !config.Overwrite {
-			targetPath, err = avoidExistsFile2(dest, path)
-			if err != nil {
-				log.Printf("can't avoid exists file, the error is:\n%v", err)
-				return err
+		pool.submit(func() {
+			if ctx.Err() != nil {
+				// the program is stopping, the file is transferred in the next run
+				if config.trackDatasets() {
+					state.datasetIncomplete(datasetOf(path, config.StartLevel))
+				}
+				result.add(errFileNotReady)
+				return
+			}
+			result.add(moveSourceFile(transferCtx, source, dests, dustbin, quarantine, path, info, config, state))
+		})
+		return nil
+	}, func(path string, d fs.DirEntry, level int, err error) error {
+		if level == 0 {
+			state.logf("can't read source folder, the error is:\n%v", err)
+			sourceRead = false
+			result.fail()
+			return err
+		}
+		if err == nil {
+			listing.listed[path] = true
+		}
+		pool.exitDir(func() {
+			if exitSourceDir(transferCtx, source, dests, dustbin, path, level, err, config, state) != nil {
+				result.fail()
+			}
+		})
+		return nil
+	})
+	pool.wait()
+	if sourceRead {
+		listing.listed["."] = true
+		state.pruneKept(listing)
+		if state.pruneRemoved(listing, dests) {
+			for _, dest := range dests {
+				cleanDestination(dest, state)
 			}
 		}
+	}
+	return result
+}
 
-		// copy file
-		targetFile, err := dest.Create(targetPath)
-		if err != nil {
-			log.Printf("can't open target file, the error is:\n%v", err)
-			return err
+// enterSourceDir makes dir for the destinations, and for the dustbin if files are moved to it.
+func enterSourceDir(source DirFs, dests []*destination, dustbin string, path string, level int, config ExecutionConfig, state *TransferState) error {
+	if config.trackDatasets() {
+		if level == config.StartLevel && !state.enterDataset(source, path, config) {
+			if config.DatasetIdleSeconds > 0 {
+				// walk the dataset to detect changes, but don't transfer it
+				return nil
+			}
+			return fs.SkipDir
+		}
+		if !state.datasetReady(path, nil, config) {
+			return nil
 		}
-		defer targetFile.Close()
-		sourceFile, err := source.OpenFile(path, os.O_RDWR, 0)
+	}
+	destPath := stagingPath(path, datasetOfDir(path, level, config.StartLevel), config)
+	for _, dest := range dests {
+		err := dest.MkdirAll(destPath)
 		if err != nil {
-			log.Printf("can't open source file, the error is:\n%v", err)
+			state.logf("can't create parent folders on %s for folder %s,\nthe error is: %v\n", dest.label(), destPath, err)
+			if dest.optional {
+				continue
+			}
 			return err
 		}
-		defer sourceFile.Close()
-		_, err = io.Copy(targetFile, sourceFile)
-		if err != nil {
-			log.Printf("can't copy file to the remote server, the error is:\n%v", err)
+		dest.Chown(destPath, config.Uid, config.Gid)
+	}
+	if !config.usesDustbin() {
+		return nil
+	}
+	err := source.MkdirAllAbs(dustbin, path)
+	if err != nil {
+		state.logf("can't create parent folders on dustbin for folder %s,\nthe error is: %v\n", path, err)
+		return err
+	}
+	return nil
+}
+
+// moveSourceFile moves the file unless it failed recently, and counts the failures.
+// errFileNotReady is returned if the file is left for a later scan.
+func moveSourceFile(ctx context.Context, source DirFs, dests []*destination, dustbin string, quarantine string, path string, info fs.FileInfo, config ExecutionConfig, state *TransferState) error {
+	var err error
+	// skip files that failed recently
+	if state.inBackoff(path) {
+		err = errFileNotReady
+	} else if !config.Windows.open(time.Now()) {
+		// the transfer window closed during the scan, the file is transferred in the next window
+		err = errFileNotReady
+	} else if ctx.Err() != nil {
+		// the running transfers are aborted
+		err = errFileNotReady
+	} else {
+		err = moveFile(ctx, source, dests, dustbin, path, info, config, state)
+		if err == nil {
+			state.clearFailures(path)
+		} else if errors.Is(err, errTransferAborted) {
+			// the partial file is kept, the transfer is resumed after the restart
+			err = errFileNotReady
+		} else if isConnectionError(err) {
+			// not caused by the file, it's retried in the next cycle without counting the failure
+			state.logf("transfer of file %s failed because of a connection error\n", path)
+		} else if err != errFileNotReady {
+			handleFailure(source, quarantine, path, err, config, state)
+		}
+	}
+	if err != nil && config.trackDatasets() {
+		state.datasetIncomplete(datasetOf(path, config.StartLevel))
+	}
+	return err
+}
+
+// exitSourceDir completes the dataset and clears the empty folder, after all files in the folder are done.
+// An error is returned if the folder can't be read or the dataset can't be completed.
+func exitSourceDir(ctx context.Context, source DirFs, dests []*destination, dustbin string, path string, level int, err error, config ExecutionConfig, state *TransferState) error {
+	if err != nil {
+		state.logf("can't read folder %s, the error is:\n%v", path, err)
+		if config.trackDatasets() && level >= config.StartLevel {
+			state.datasetIncomplete(datasetOfDir(path, level, config.StartLevel))
+		}
+	}
+	if config.trackDatasets() {
+		if level == config.StartLevel {
+			ready, incomplete := state.exitDataset(path)
+			if !ready {
+				return err
+			}
+			if incomplete {
+				state.logf("dataset %s is not transferred completely, it will be retried\n", path)
+				return err
+			}
+			if !completeDataset(ctx, source, dests, dustbin, path, config, state) {
+				return errors.Errorf("dataset %s can't be completed", path)
+			}
+		} else if !state.datasetReady(path, nil, config) {
 			return err
 		}
-		sourceFile.Close()
+	}
+	if err != nil {
+		return err
+	}
+	// clear empty folders, the folders of renamed or kept files are not empty
+	if level >= config.StartLevel && config.removesSource() {
+		source.Remove(path)
+	}
+	return nil
+}
 
-		// chmod
-		err = dest.Chmod(targetPath, FileFileMode)
+// moveFile copies one file to the destinations, and handles the source file as the after-transfer policy says.
+func moveFile(ctx context.Context, source DirFs, dests []*destination, dustbin string, path string, info fs.FileInfo, config ExecutionConfig, state *TransferState) error {
+	// skip files that are still being written
+	if !state.isStable(path, info, config) {
+		return errFileNotReady
+	}
+	copies, err := copyToDestinations(ctx, source, dests, path, info, func(dest *destination) (string, error) {
+		targetPath, _, err := targetPathOf(dest, path, info, config, state)
 		if err != nil {
-			log.Printf("failed to change file mode, the error is:\n%v", err)
+			state.logf("can't avoid exists file, the error is:\n%v", err)
 		}
+		return targetPath, err
+	}, config, state)
+	if err != nil {
+		return err
+	}
+
+	err = finishSourceFile(source, dustbin, path, copies, config, state)
+	if err != nil {
+		state.logf("failed to %s the source file %s after the transfer, the error is:\n%v", config.afterTransfer(), path, err)
+	}
+
+	return nil
+}
+
+// targetPathOf returns the destination path of the file, and whether an unfinished transfer to it is resumed.
+func targetPathOf(dest *destination, path string, info fs.FileInfo, config ExecutionConfig, state *TransferState) (string, bool, error) {
+	targetPath := stagingPath(path, datasetOf(path, config.StartLevel), config)
+	if record := state.resumeRecord(dest.resumeKey(path)); record != nil && record.matches(info) {
+		// continue the unfinished transfer to the same target
+		return record.Target, true, nil
+	}
+	if config.Overwrite {
+		return targetPath, false, nil
+	}
+	// rename target file if needed
+	targetPath, err := avoidExistsFile2(dest, targetPath)
+	return targetPath, false, err
+}
 
-		// chown
-		if config.Gid != 0 {
-			err = dest.Chown(targetPath, config.Uid, config.Gid)
+// completeDataset handles the marker file after all other files of the dataset were transferred,
+// the marker is transferred as the last file if marker-to-dest is set, otherwise it's removed.
+// Then the staged dataset is published. It returns false if the dataset must be completed again in the next cycle.
+func completeDataset(ctx context.Context, source DirFs, dests []*destination, dustbin string, path string, config ExecutionConfig, state *TransferState) bool {
+	// the datasets of kept files are completed in every scan, it's only logged the first time
+	quiet := config.afterTransfer() == afterKeep && config.DatasetMarker == ""
+	if config.DatasetMarker != "" {
+		markerPath := filepath.Join(path, config.DatasetMarker)
+		info, err := source.Lstat(markerPath)
+		if err == nil && config.transferredBefore(markerPath, info, state) {
+			// the dataset was completed in an earlier scan, only the files added since then are published
+			quiet = true
+		} else if err == nil {
+			if config.MarkerToDest {
+				var copies *CopyRecord
+				copies, err = copyToDestinations(ctx, source, dests, markerPath, info, func(dest *destination) (string, error) {
+					return stagingPath(markerPath, path, config), nil
+				}, config, state)
+				if err != nil {
+					state.logf("failed to transfer marker of dataset %s, the error is:\n%v", path, err)
+					return false
+				}
+				err = finishSourceFile(source, dustbin, markerPath, copies, config, state)
+			} else if config.afterTransfer() == afterKeep {
+				err = state.addKept(markerPath, &CopyRecord{Size: info.Size(), ModTime: info.ModTime()})
+			} else {
+				err = source.Remove(markerPath)
+			}
+			if err != nil {
+				state.logf("failed to remove marker of dataset %s, the error is:\n%v", path, err)
+				return false
+			}
+		}
+	}
+	if config.stagingMode() {
+		for _, dest := range dests {
+			err := publishDataset(dest, path, config)
 			if err != nil {
-				log.Printf("failed to change file owner, the error is:\n%v", err)
+				state.logf("failed to publish dataset %s on the %s, the staged files are kept, the error is:\n%v", path, dest.label(), err)
+				if !dest.optional {
+					return false
+				}
 			}
 		}
+	}
+	state.removeDataset(path)
+	if !quiet {
+		state.logf("dataset %s is transferred\n", path)
+	}
+	return true
+}
 
-		// move to dustbin
-		err = source.Move(path, dustbin)
+// transferFile copies the source file to a hidden partial file on the destination,
+// verifies it and renames it to the target path.
+// If the copy is interrupted, the partial file is kept and the transfer is resumed the next time.
+// It returns the checksum of the file, empty if the checksum is none.
+func transferFile(ctx context.Context, source DirFs, dest *destination, path string, info fs.FileInfo, targetPath string, config ExecutionConfig, state *TransferState) (string, error) {
+	// copy file to a temporary file, it's renamed to the target path after the transfer succeeded
+	tmpPath := partialPath(targetPath)
+	offset := resumeOffset(source, dest, path, info, tmpPath, config, state)
+	// large files are uploaded in parallel byte ranges if the destination supports it,
+	// the partial file of a chunked upload has holes, so it can't be resumed
+	streams := uploadStreams(dest.DirFs, info.Size()-offset)
+	// the partial file is recorded before it's created, so it's found again if the program is killed
+	resumeKey := dest.resumeKey(path)
+	saveResumeRecord := func(chunked bool) {
+		err := state.setResumeRecord(resumeKey, &ResumeRecord{
+			Target:  targetPath,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Stale:   chunked,
+		})
 		if err != nil {
-			log.Printf("failed to move file to the dustbin, the error is:\n%v", err)
+			state.logf("can't save transfer state, the error is:\n%v", err)
 		}
-
-		return nil
-	}, func(path string, d fs.DirEntry, level int, err error) error {
-		// clear empty folders
-		if level >= config.StartLevel {
-			source.Remove(path)
+	}
+	saveResumeRecord(streams > 1)
+	targetFile, targetConn, err := openWithConnection(dest.DirFs, func(dirfs DirFs) (File, error) {
+		if offset > 0 {
+			return dirfs.OpenFile(tmpPath, os.O_WRONLY, FileFileMode)
 		}
-		return nil
+		return dirfs.Create(tmpPath)
 	})
+	if err == nil && offset > 0 {
+		_, err = targetFile.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		state.logf("can't open target file, the error is:\n%v", err)
+		return "", err
+	}
+	defer targetFile.Close()
+	targetWriterAt, ok := targetFile.(io.WriterAt)
+	if !ok && streams > 1 {
+		streams = 1
+		saveResumeRecord(false)
+	}
+	succeeded := false
+	keepPartial := false
+	defer func() {
+		if !succeeded && !keepPartial {
+			targetFile.Close()
+			dest.Remove(tmpPath)
+			state.removeResumeRecord(resumeKey)
+		}
+	}()
+	sourceFile, sourceConn, err := openWithConnection(source, func(dirfs DirFs) (File, error) {
+		return dirfs.Open(path)
+	})
+	if err != nil {
+		state.logf("can't open source file, the error is:\n%v", err)
+		return "", err
+	}
+	defer sourceFile.Close()
+	// compute the checksum while streaming
+	hasher, err := newHash(config.checksum())
+	if err != nil {
+		state.logf("can't create checksum, the error is:\n%v", err)
+		return "", err
+	}
+	if offset > 0 {
+		state.logf("resume transfer of file %s at %d bytes\n", path, offset)
+		// the checksum must cover the part that was already transferred
+		if hasher != nil {
+			_, err = io.CopyN(hasher, &activityReader{reader: sourceFile}, offset)
+		} else {
+			_, err = sourceFile.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			state.logf("can't skip the transferred part of source file, the error is:\n%v", err)
+			return "", err
+		}
+	}
+	idleTimeout := time.Duration(config.IdleTimeout) * time.Second
+	abort := transferAborter{
+		state: state,
+		path:  path,
+		// closing the files only stops this transfer, the other transfers keep the shared connections
+		close: func() {
+			sourceFile.Close()
+			targetFile.Close()
+		},
+		// the connection doesn't answer, the next file gets a new one
+		drop: func(reading bool) {
+			if reading {
+				dropConnection(source, sourceConn)
+			} else {
+				dropConnection(dest.DirFs, targetConn)
+			}
+		},
+	}
+	// a transfer that doesn't stop may still write to the partial file, it's removed when the destination is cleaned
+	leftBehind := func(err error) bool {
+		var leftBehindErr *leftBehindError
+		if !errors.As(err, &leftBehindErr) {
+			return false
+		}
+		state.logf("can't copy file %s, the transfer is left behind, the partial file can't be resumed, the error is:\n%v", path, err)
+		saveResumeRecord(true)
+		keepPartial = true
+		return true
+	}
+	// a copy error may be caused by a source file that shrank, like io.ErrUnexpectedEOF of a chunked upload,
+	// it's not a connection error, the file is transferred again once it's stable
+	sourceChanged := func() bool {
+		currentInfo, err := source.Lstat(path)
+		if err != nil || (currentInfo.Size() == info.Size() && currentInfo.ModTime().Equal(info.ModTime())) {
+			return false
+		}
+		state.logf("source file %s was changed during the transfer, it will be transferred again\n", path)
+		state.resetStability(path)
+		return true
+	}
+	var written int64
+	sourceReaderAt, ok := sourceFile.(io.ReaderAt)
+	if streams > 1 && ok {
+		state.logf("upload file %s in %d parallel streams\n", path, streams)
+		written, err = copyChunkedWithTimeout(ctx, targetWriterAt, state.limitReaderAt(sourceReaderAt), offset, info.Size(), streams, idleTimeout, config.maxTransferDuration(info.Size()), abort)
+		if leftBehind(err) {
+			return "", err
+		}
+		if err != nil && sourceChanged() {
+			return "", errFileNotReady
+		}
+		if err != nil {
+			state.logf("can't copy file to the remote server, the error is:\n%v", err)
+			return "", err
+		}
+		// the ranges were written out of order, the checksum is computed from the source afterwards
+		if hasher != nil {
+			_, err = io.Copy(hasher, &activityReader{reader: io.NewSectionReader(sourceReaderAt, offset, info.Size()-offset)})
+			if err != nil {
+				state.logf("can't compute checksum of source file, the error is:\n%v", err)
+				return "", err
+			}
+		}
+	} else {
+		var writer io.Writer = targetFile
+		if hasher != nil {
+			writer = io.MultiWriter(targetFile, hasher)
+		}
+		written, err = copyWithTimeout(ctx, writer, state.limitReader(sourceFile), idleTimeout, config.maxTransferDuration(info.Size()), abort)
+		if leftBehind(err) {
+			return "", err
+		}
+		if err != nil && sourceChanged() {
+			return "", errFileNotReady
+		}
+		if err != nil {
+			state.logf("can't copy file to the remote server, the partial file is kept to resume the transfer, the error is:\n%v", err)
+			keepPartial = true
+			return "", err
+		}
+	}
+	sourceFile.Close()
+
+	// throw the copy away if the source file was changed during the transfer
+	currentInfo, err := source.Lstat(path)
+	if err != nil {
+		state.logf("can't check source file after the transfer, the error is:\n%v", err)
+		return "", err
+	}
+	if offset+written != info.Size() || currentInfo.Size() != info.Size() || !currentInfo.ModTime().Equal(info.ModTime()) {
+		state.logf("source file %s was changed during the transfer, it will be transferred again\n", path)
+		state.resetStability(path)
+		// the file is still being written, it's not counted as a failure
+		return "", errFileNotReady
+	}
+	err = targetFile.Close()
+	if err != nil {
+		state.logf("can't close target file, the error is:\n%v", err)
+		return "", err
+	}
+
+	// verify the checksum of the destination file
+	var sourceSum string
+	if hasher != nil {
+		sourceSum = hashSum(hasher)
+		targetSum, err := hashFile(dest, tmpPath, config.checksum())
+		if err != nil {
+			state.logf("can't compute checksum of target file %s, the source file is kept, the error is:\n%v", targetPath, err)
+			return "", err
+		}
+		if sourceSum != targetSum {
+			state.logf("failed to transfer file %s, %s checksum mismatch, source: %s, target: %s, the source file is kept\n", path, config.checksum(), sourceSum, targetSum)
+			return "", errors.Errorf("checksum mismatch for file %s", path)
+		}
+	}
+
+	// chmod
+	err = dest.Chmod(tmpPath, FileFileMode)
+	if err != nil {
+		state.logf("failed to change file mode, the error is:\n%v", err)
+	}
+
+	// chown
+	if config.Gid != 0 {
+		err = dest.Chown(tmpPath, config.Uid, config.Gid)
+		if err != nil {
+			state.logf("failed to change file owner, the error is:\n%v", err)
+		}
+	}
+
+	// publish the file under its final name
+	err = dest.Rename(tmpPath, targetPath)
+	if err != nil {
+		state.logf("can't rename %s to %s, the error is:\n%v", tmpPath, targetPath, err)
+		return "", err
+	}
+	succeeded = true
+	state.removeResumeRecord(resumeKey)
+	return sourceSum, nil
+}
+
+// resumeOffset returns the number of bytes that can be kept from the partial file of an earlier transfer,
+// 0 means the transfer starts over.
+func resumeOffset(source DirFs, dest *destination, path string, info fs.FileInfo, tmpPath string, config ExecutionConfig, state *TransferState) int64 {
+	record := state.resumeRecord(dest.resumeKey(path))
+	if record == nil || record.Stale || partialPath(record.Target) != tmpPath || !record.matches(info) {
+		return 0
+	}
+	partialInfo, err := dest.Lstat(tmpPath)
+	if err != nil || partialInfo.Size() > info.Size() {
+		return 0
+	}
+	offset := partialInfo.Size()
+	if config.ResumeVerify && offset > 0 {
+		algorithm := config.checksum()
+		if !config.verifies() {
+			algorithm = "sha256"
+		}
+		sourceSum, err := hashFilePrefix(source, path, offset, algorithm)
+		if err != nil {
+			state.logf("can't compute checksum of the transferred part of %s, the error is:\n%v", path, err)
+			return 0
+		}
+		targetSum, err := hashFilePrefix(dest, tmpPath, offset, algorithm)
+		if err != nil {
+			state.logf("can't compute checksum of partial file %s, the error is:\n%v", tmpPath, err)
+			return 0
+		}
+		if sourceSum != targetSum {
+			state.logf("partial file %s doesn't match the source file, restart the transfer\n", tmpPath)
+			return 0
+		}
+	}
+	return offset
+}
+
+// partialPath returns the temporary path used while transferring a file to the path.
+func partialPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+PartialFileSuffix)
+}
+
+func isPartialFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, PartialFileSuffix)
+}
+
+// cleanPartialFiles removes the partial files of the destination that can't be resumed, they are left by
+// chunked uploads and by transfers whose source file was removed. Only the recorded partial files are checked,
+// the destination is not scanned.
+func cleanPartialFiles(dest *destination, state *TransferState) {
+	for key, record := range state.staleResumeRecords(dest) {
+		partial := partialPath(record.Target)
+		if _, err := dest.Lstat(partial); err == nil {
+			state.logf("remove partial file %s left by an interrupted transfer\n", partial)
+			err = dest.Remove(partial)
+			if err != nil {
+				state.logf("can't remove partial file %s, the error is:\n%v", partial, err)
+				continue
+			}
+		}
+		state.removeResumeRecord(key)
+	}
 }
 
 func avoidExistsFile2(dest DirFs, path string) (string, error) {
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// actions of the filter rules
+const (
+	filterSkip    = "skip"    // leave the file in the source
+	filterDelete  = "delete"  // remove the file from the source
+	filterDustbin = "dustbin" // move the file to the dustbin without transferring it
+)
+
+// FilterRule selects source files that are not transferred. The pattern is matched like in .gitignore:
+// a pattern without a slash matches the file name in any folder, a pattern with a slash matches the path
+// from the root of the source, a pattern with a trailing slash matches the files in the folders of that name,
+// and ** matches any number of folders. A pattern with a leading ! includes the files again, so they are transferred.
+// The last rule that matches a file applies.
+type FilterRule struct {
+	Pattern     string // gitignore style pattern, an empty pattern matches every file
+	LargerThan  int64  `yaml:"larger-than"`  // only files larger than this number of bytes match
+	SmallerThan int64  `yaml:"smaller-than"` // only files smaller than this number of bytes match
+	OlderThan   int    `yaml:"older-than"`   // only files that were not modified for this number of seconds match
+	NewerThan   int    `yaml:"newer-than"`   // only files that were modified within this number of seconds match
+	Action      string // skip (default), delete or dustbin, it's ignored by the rules that include files
+}
+
+// defaultFilter removes the files macOS leaves in every folder, it's the first rule, so it can be overridden.
+var defaultFilter = FilterRule{Pattern: ".DS_Store*", Action: filterDelete}
+
+// readOnlyDefaultFilter replaces the default rule if the source is not modified, the files are skipped instead.
+var readOnlyDefaultFilter = FilterRule{Pattern: defaultFilter.Pattern, Action: filterSkip}
+
+// sourceFilter is a compiled filter rule.
+type sourceFilter struct {
+	rule     FilterRule
+	include  bool // the rule includes the files again
+	dirOnly  bool // the pattern matches the folders of the file
+	anchored bool // the pattern matches the path from the root of the source
+	regexp   *regexp.Regexp
+}
+
+// filters compiles the filter rules of the job. With the after-transfer policy keep the source is not modified,
+// so the default rule skips the files instead of removing them.
+func (c ExecutionConfig) filters() ([]*sourceFilter, error) {
+	if c.afterTransfer() == afterKeep {
+		return compileRules(append([]FilterRule{readOnlyDefaultFilter}, c.Filters...))
+	}
+	return compileFilters(c.Filters)
+}
+
+// compileFilters compiles the rules after the default rule.
+func compileFilters(rules []FilterRule) ([]*sourceFilter, error) {
+	return compileRules(append([]FilterRule{defaultFilter}, rules...))
+}
+
+func compileRules(rules []FilterRule) ([]*sourceFilter, error) {
+	filters := make([]*sourceFilter, 0, len(rules))
+	for _, rule := range rules {
+		filter, err := compileFilter(rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid filter %s", rule.Pattern)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+func compileFilter(rule FilterRule) (*sourceFilter, error) {
+	switch rule.Action {
+	case "":
+		rule.Action = filterSkip
+	case filterSkip, filterDelete, filterDustbin:
+	default:
+		return nil, errors.Errorf("unsupported filter action: %s", rule.Action)
+	}
+	filter := &sourceFilter{rule: rule}
+	pattern := rule.Pattern
+	if strings.HasPrefix(pattern, "!") {
+		filter.include = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		filter.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		filter.anchored = true
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+	if pattern == "" {
+		if filter.include || filter.dirOnly || filter.anchored {
+			return nil, errors.New("empty pattern")
+		}
+		if rule.LargerThan <= 0 && rule.SmallerThan <= 0 && rule.OlderThan <= 0 && rule.NewerThan <= 0 {
+			return nil, errors.New("the rule matches every file, set a pattern, a size or an age")
+		}
+		return filter, nil
+	}
+	expr, err := globToRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	filter.regexp, err = regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// globToRegexp converts a gitignore style pattern to a regular expression.
+func globToRegexp(pattern string) (string, error) {
+	var expr strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			// any number of folders
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return "", errors.New("unclosed character class")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String(), nil
+}
+
+// matches reports whether the rule matches the file.
+func (f *sourceFilter) matches(filePath string, info fs.FileInfo, now time.Time) bool {
+	if f.regexp != nil && !f.matchesPath(filepath.ToSlash(filePath)) {
+		return false
+	}
+	if f.rule.LargerThan > 0 && info.Size() <= f.rule.LargerThan {
+		return false
+	}
+	if f.rule.SmallerThan > 0 && info.Size() >= f.rule.SmallerThan {
+		return false
+	}
+	age := now.Sub(info.ModTime())
+	if f.rule.OlderThan > 0 && age < time.Duration(f.rule.OlderThan)*time.Second {
+		return false
+	}
+	if f.rule.NewerThan > 0 && age >= time.Duration(f.rule.NewerThan)*time.Second {
+		return false
+	}
+	return true
+}
+
+func (f *sourceFilter) matchesPath(filePath string) bool {
+	if !f.dirOnly {
+		if f.anchored {
+			return f.regexp.MatchString(filePath)
+		}
+		return f.regexp.MatchString(path.Base(filePath))
+	}
+	dirs := strings.Split(path.Dir(filePath), "/")
+	for i := range dirs {
+		dir := dirs[i]
+		if f.anchored {
+			dir = strings.Join(dirs[:i+1], "/")
+		}
+		if dir != "." && f.regexp.MatchString(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterFile returns the filter rule that applies to the file, nil if the file is transferred.
+func filterFile(filters []*sourceFilter, path string, info fs.FileInfo) *sourceFilter {
+	now := time.Now()
+	var matched *sourceFilter
+	for _, filter := range filters {
+		if filter.matches(path, info, now) {
+			matched = filter
+		}
+	}
+	if matched == nil || matched.include {
+		return nil
+	}
+	return matched
+}
+
+// applyFilter removes the file from the source or moves it to the dustbin, as the filter says.
+// Skipped files are left in the source.
+func applyFilter(source DirFs, dustbin string, path string, filter *sourceFilter, state *TransferState) {
+	var err error
+	switch filter.rule.Action {
+	case filterDelete:
+		if filter.rule != defaultFilter {
+			state.logf("remove file %s, it matches the filter %s\n", path, filter.rule.Pattern)
+		}
+		err = source.Remove(path)
+	case filterDustbin:
+		state.logf("move file %s to the dustbin without transfer, it matches the filter %s\n", path, filter.rule.Pattern)
+		err = source.Move(path, dustbin)
+	}
+	if err != nil {
+		state.logf("can't apply the filter %s to file %s, the error is:\n%v", filter.rule.Pattern, path, err)
+	}
+}
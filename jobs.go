@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// rootedDirFs is a file system that can be used with another root folder, so jobs can share a connection.
+type rootedDirFs interface {
+	// withRoot returns a file system that uses the same connection with the root folder path
+	withRoot(path string) DirFs
+}
+
+// sharedConnection is a creator used by several jobs.
+type sharedConnection struct {
+	creator DirFsCreator
+	users   int
+}
+
+// connectionPool shares the connections of the jobs, jobs that connect to the same server
+// with the same account and settings use one connection.
+type connectionPool struct {
+	mutex       sync.Mutex
+	connections map[DirFsConfig]*sharedConnection
+}
+
+func newConnectionPool() *connectionPool {
+	return &connectionPool{
+		connections: make(map[DirFsConfig]*sharedConnection),
+	}
+}
+
+// connectionKey removes the settings that don't belong to the connection from the config.
+func connectionKey(config DirFsConfig) DirFsConfig {
+	config.Path = ""
+	config.ReconnectAttempts = 0
+	config.Watch = false
+	config.RescanInterval = 0
+	return config
+}
+
+// acquire returns a creator of the file system of the config, it uses the connection of the pool.
+// The creator must be released when it's not used any more.
+func (p *connectionPool) acquire(config DirFsConfig) (DirFsCreator, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := connectionKey(config)
+	shared, ok := p.connections[key]
+	if !ok {
+		creator, err := CreateFsCreator(config)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedConnection{creator: creator}
+		p.connections[key] = shared
+	}
+	shared.users++
+	return &rootedCreator{shared: shared.creator, path: config.Path}, nil
+}
+
+// release closes the connection of the config after the last job released it.
+func (p *connectionPool) release(config DirFsConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := connectionKey(config)
+	shared, ok := p.connections[key]
+	if !ok {
+		return
+	}
+	shared.users--
+	if shared.users <= 0 {
+		shared.creator.close()
+		delete(p.connections, key)
+	}
+}
+
+// rootedCreator creates the file system of a shared connection with the root folder of a job.
+type rootedCreator struct {
+	shared DirFsCreator
+	path   string
+}
+
+func (c *rootedCreator) create(job string) (DirFs, error) {
+	dirfs, err := c.shared.create(job)
+	if err != nil {
+		return nil, err
+	}
+	if rooted, ok := dirfs.(rootedDirFs); ok {
+		return rooted.withRoot(c.path), nil
+	}
+	return dirfs, nil
+}
+
+// close closes the shared connection, the next operation of any job creates a new one.
+func (c *rootedCreator) close() {
+	c.shared.close()
+}
+
+func (c *rootedCreator) invalidate(dirfs DirFs) {
+	c.shared.invalidate(dirfs)
+}
+
+var _ DirFsCreator = (*rootedCreator)(nil)
+
+// jobStatus collects the status of the jobs, systemd shows them in one line.
+type jobStatus struct {
+	mutex  sync.Mutex
+	names  []string
+	status map[string]string
+}
+
+func newJobStatus(jobs []JobConfig) *jobStatus {
+	status := &jobStatus{
+		status: make(map[string]string),
+	}
+	for _, job := range jobs {
+		status.names = append(status.names, job.Name)
+	}
+	return status
+}
+
+// set changes the status of the job and sends the status of all jobs to systemd.
+func (s *jobStatus) set(name string, status string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status[name] = status
+	var line []string
+	for _, name := range s.names {
+		status, ok := s.status[name]
+		if !ok {
+			continue
+		}
+		if name != "" {
+			status = name + ": " + status
+		}
+		line = append(line, status)
+	}
+	sdNotify("STATUS=" + strings.Join(line, "; "))
+}
+
+// jobLogf logs a message of the job, the message is prefixed with the name of the job.
+func jobLogf(job string, format string, v ...interface{}) {
+	if job == "" {
+		log.Printf(format, v...)
+		return
+	}
+	log.Print("[" + job + "] " + fmt.Sprintf(format, v...))
+}
+
+// loadJobState loads the transfer state of the job.
+func loadJobState(config JobConfig) (*TransferState, error) {
+	state, err := LoadTransferState(config.StateFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't load transfer state")
+	}
+	state.job = config.Name
+	return state, nil
+}
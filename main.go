@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 	"syscall"
 
@@ -18,19 +20,37 @@ var (
 	asDaemon   = flag.Bool("d", false, "run in daemon")
 	encrypt    = flag.String("encrypt", "", "encrypt password")
 	decrypt    = flag.String("decrypt", "", "decrypt password")
+	dryRun     = flag.Bool("dry-run", false, "print the actions of the next scan without transferring, moving or deleting anything")
+	format     = flag.String("format", "text", "output format of the dry run, text or json")
+	service    = flag.Bool("service", false, "run in foreground as a systemd service, log to stderr and read the secret from the systemd credential "+secretCredential)
+	once       = flag.Bool("once", false, "scan the source once and exit, the exit code is 0 if all files that were ready were transferred, 1 if some failed, 2 if there was nothing to transfer, 3 if files are not ready yet")
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run returns the exit code of the program.
+func run() int {
 	flag.Parse()
 
 	if *encrypt != "" {
 		encryptFunc()
-		return
+		return 0
 	}
 
 	if *decrypt != "" {
 		decryptFunc()
-		return
+		return 0
+	}
+
+	if *service {
+		if *asDaemon {
+			log.Fatal("-service can't be combined with -d")
+		}
+		// the journal adds the time to every line
+		log.SetFlags(0)
+		log.SetOutput(os.Stderr)
 	}
 
 	if *asDaemon {
@@ -48,15 +68,16 @@ func main() {
 			log.Fatal("Unable to run: ", err)
 		}
 		if d != nil {
-			return
+			return 0
 		}
 		defer cntxt.Release()
+		defer log.Print("daemon stopped")
 
 		log.Print("- - - - - - - - - - - - - - -")
 		log.Print("daemon started")
 	}
 
-	startMoveFile()
+	return startMoveFile()
 }
 
 func encryptFunc() {
@@ -107,7 +128,10 @@ func inputSecret() (string, error) {
 	return secret, nil
 }
 
-func startMoveFile() {
+// secretCredential is the name of the systemd credential that holds the decryption secret
+const secretCredential = "tohpc-secret"
+
+func startMoveFile() int {
 	var err error
 	var secretStr string
 	if *secretFile != "" {
@@ -115,16 +139,18 @@ func startMoveFile() {
 		secret, err = ioutil.ReadFile(*secretFile)
 		if err != nil {
 			log.Fatalf("can't read pwdfile: %v", err)
-			return
 		}
 		os.Remove(*secretFile)
 		secretStr = string(secret)
-	} else if !*asDaemon {
+	} else if credential, ok, err := readCredential(secretCredential); err != nil {
+		log.Fatalf("%v", err)
+	} else if ok {
+		secretStr = credential
+	} else if !*asDaemon && !*service {
 		fmt.Println("Input password for private key:")
 		bytePassword, err := term.ReadPassword(int(syscall.Stdin))
 		if err != nil {
 			log.Fatalf("error in input password, error: %v", err)
-			return
 		}
 		secretStr = string(bytePassword)
 	}
@@ -133,5 +159,42 @@ func startMoveFile() {
 	if err != nil {
 		log.Fatalf("failed to load config, %v", err)
 	}
-	KeepFileMove(config)
+	if *dryRun {
+		err = DryRun(config, *format, os.Stdout)
+		if err != nil {
+			log.Printf("dry run failed, %v\n", err)
+			return exitFailed
+		}
+		return 0
+	}
+	// stop gracefully on SIGTERM and SIGINT, a second signal kills the program
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		sdNotify("STOPPING=1")
+		stop()
+	}()
+	go runWatchdog(ctx)
+	if *once {
+		return FileMoveOnce(ctx, config)
+	}
+	// reload the config on SIGHUP
+	reloader := newConfigReloader("./config.yml", secretStr)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			log.Printf("received SIGHUP, reload config\n")
+			sdNotify("RELOADING=1")
+			reloader.reload()
+			sdNotify("READY=1")
+		}
+	}()
+	KeepFileMove(ctx, config, reloader)
+	if ctx.Err() != nil {
+		return 0
+	}
+	return exitFailed
 }
@@ -1,7 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -53,3 +69,1249 @@ func TestEncryption(t *testing.T) {
 		t.Errorf("encrypt and decrypt failed, the result is: %s", string(dataBytes))
 	}
 }
+
+func createTestFile(t *testing.T, path string, content string) {
+	err := os.MkdirAll(filepath.Dir(path), DirFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(content), FileFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileMoveChecksum(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	dustbin := t.TempDir()
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset/frames/movie.tiff"), "movie data")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dest := &LocalDirFs{DirFsBase{Path: destDir}}
+	state, _ := LoadTransferState("")
+	FileMove(context.Background(), source, []*destination{{DirFs: dest}}, dustbin, "", ExecutionConfig{StartLevel: 3, Checksum: "sha256"}, state)
+
+	data, err := ioutil.ReadFile(filepath.Join(destDir, "user/project/dataset/frames/movie.tiff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "movie data" {
+		t.Errorf("unexpected destination content: %s", string(data))
+	}
+	if _, err = os.Stat(filepath.Join(dustbin, "user/project/dataset/frames/movie.tiff")); err != nil {
+		t.Errorf("source file is not moved to the dustbin: %v", err)
+	}
+
+	// the default checksum detects a damaged copy, the source file stays in place
+	path := "user/project/dataset/frames/movie2.tiff"
+	createTestFile(t, filepath.Join(sourceDir, path), "movie data")
+	corrupting := &corruptingDirFs{dest}
+	result := FileMove(context.Background(), source, []*destination{{DirFs: corrupting}}, dustbin, "", ExecutionConfig{StartLevel: 3}, state)
+	if result.Failed != 1 {
+		t.Errorf("checksum mismatch is not a failure: %+v", result)
+	}
+	if _, err = os.Stat(filepath.Join(sourceDir, path)); err != nil {
+		t.Errorf("source file is not kept after a checksum mismatch: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(destDir, path)); !os.IsNotExist(err) {
+		t.Errorf("damaged copy is published: %v", err)
+	}
+	if record := state.Failures[path]; record == nil || record.Count != 1 {
+		t.Errorf("checksum mismatch is not counted: %v", record)
+	}
+}
+
+// corruptingDirFs changes the content of a file before it's read back, like a copy that was damaged on the way.
+type corruptingDirFs struct {
+	*LocalDirFs
+}
+
+func (fs *corruptingDirFs) Open(name string) (File, error) {
+	ioutil.WriteFile(fs.abspath(name), []byte("damaged!!!"), 0640)
+	return fs.LocalDirFs.Open(name)
+}
+
+func TestFileMoveFanOut(t *testing.T) {
+	sourceDir := t.TempDir()
+	scratchDir := t.TempDir()
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	dustbin := t.TempDir()
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset/movie.tiff"), "movie data")
+	// the archive is a file, so the copy to it fails
+	createTestFile(t, archiveDir, "")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dests := []*destination{
+		{DirFs: &LocalDirFs{DirFsBase{Path: scratchDir}}, name: "scratch"},
+		{DirFs: &LocalDirFs{DirFsBase{Path: archiveDir}}, name: "archive"},
+	}
+	state, _ := LoadTransferState("")
+	config := ExecutionConfig{StartLevel: 3}
+	FileMove(context.Background(), source, dests, dustbin, "", config, state)
+	if _, err := os.Stat(filepath.Join(sourceDir, "user/project/dataset/movie.tiff")); err != nil {
+		t.Fatalf("source file is moved before all destinations have it: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(scratchDir, "user/project/dataset/movie.tiff")); err != nil {
+		t.Fatalf("file is not copied to the available destination: %v", err)
+	}
+
+	os.Remove(archiveDir)
+	state.clearFailures("user/project/dataset/movie.tiff")
+	FileMove(context.Background(), source, dests, dustbin, "", config, state)
+	if _, err := os.Stat(filepath.Join(archiveDir, "user/project/dataset/movie.tiff")); err != nil {
+		t.Errorf("missing copy is not filled in: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(scratchDir, "user/project/dataset/movie(1).tiff")); err == nil {
+		t.Errorf("existing copy is copied again")
+	}
+	if _, err := os.Stat(filepath.Join(dustbin, "user/project/dataset/movie.tiff")); err != nil {
+		t.Errorf("source file is not moved to the dustbin: %v", err)
+	}
+	if len(state.Copies) != 0 {
+		t.Errorf("copies are not forgotten: %v", state.Copies)
+	}
+}
+
+func TestPurgeDustbin(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	dustbinDir := t.TempDir()
+	createTestFile(t, filepath.Join(sourceDir, "user/project/movie.tiff"), "movie data")
+	createTestFile(t, filepath.Join(sourceDir, "user/project/movie2.tiff"), "other data")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dests := []*destination{{DirFs: &LocalDirFs{DirFsBase{Path: destDir}}}}
+	dustbin := &LocalDirFs{DirFsBase{Path: dustbinDir}}
+	state, _ := LoadTransferState("")
+	config := ExecutionConfig{StartLevel: 2, Checksum: "sha256", Retention: RetentionConfig{Days: 14}}
+	FileMove(context.Background(), source, dests, dustbinDir, "", config, state)
+	if len(state.Dustbin) != 2 {
+		t.Fatalf("files in the dustbin are not recorded: %v", state.Dustbin)
+	}
+	purgeDustbin(context.Background(), dustbin, dests, config.Retention, state)
+	if _, err := os.Stat(filepath.Join(dustbinDir, "user/project/movie.tiff")); err != nil {
+		t.Fatalf("file is purged before the retention period is over: %v", err)
+	}
+
+	for _, record := range state.Dustbin {
+		record.Moved = record.Moved.Add(-15 * 24 * time.Hour)
+	}
+	// the changed copy can't be verified, so its file is kept
+	createTestFile(t, filepath.Join(destDir, "user/project/movie2.tiff"), "changed!!!")
+	purgeDustbin(context.Background(), dustbin, dests, RetentionConfig{Days: 14, DryRun: true}, state)
+	if _, err := os.Stat(filepath.Join(dustbinDir, "user/project/movie.tiff")); err != nil {
+		t.Fatalf("file is purged in dry run mode: %v", err)
+	}
+	plan := planDustbinPurge(dustbin, dests, dustbinDir, config.Retention, state)
+	if len(plan) != 2 || plan[0].Action != planPurge || plan[1].Action != planSkip {
+		t.Errorf("unexpected purge plan: %v", plan)
+	}
+	purgeDustbin(context.Background(), dustbin, dests, config.Retention, state)
+	if _, err := os.Stat(filepath.Join(dustbinDir, "user/project/movie.tiff")); !os.IsNotExist(err) {
+		t.Errorf("verified file is not purged: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dustbinDir, "user/project/movie2.tiff")); err != nil {
+		t.Errorf("file with a changed copy is purged: %v", err)
+	}
+	if len(state.Dustbin) != 1 {
+		t.Errorf("unexpected dustbin records: %v", state.Dustbin)
+	}
+}
+
+func TestAfterTransfer(t *testing.T) {
+	for _, policy := range []string{afterDelete, afterRename, afterKeep} {
+		sourceDir := t.TempDir()
+		destDir := t.TempDir()
+		dustbin := t.TempDir()
+		path := "user/project/movie.tiff"
+		createTestFile(t, filepath.Join(sourceDir, path), "movie data")
+		createTestFile(t, filepath.Join(sourceDir, "user/project/.DS_Store"), "")
+		var source DirFs = &LocalDirFs{DirFsBase{Path: sourceDir}}
+		if policy == afterKeep {
+			// keep is for read-only sources like instrument shares
+			source = &readOnlyDirFs{&LocalDirFs{DirFsBase{Path: sourceDir}}}
+		}
+		dests := []*destination{{DirFs: &LocalDirFs{DirFsBase{Path: destDir}}, root: destDir}}
+		state, _ := LoadTransferState("")
+		config := ExecutionConfig{StartLevel: 2, AfterTransfer: policy}
+		FileMove(context.Background(), source, dests, dustbin, "", config, state)
+		FileMove(context.Background(), source, dests, dustbin, "", config, state)
+		if _, err := os.Stat(filepath.Join(destDir, path)); err != nil {
+			t.Errorf("%s: file is not transferred: %v", policy, err)
+		}
+		if _, err := os.Stat(filepath.Join(destDir, "user/project/movie(1).tiff")); err == nil {
+			t.Errorf("%s: file is transferred again", policy)
+		}
+		if _, err := os.Stat(filepath.Join(dustbin, "user")); !os.IsNotExist(err) {
+			t.Errorf("%s: dustbin folder is created: %v", policy, err)
+		}
+		_, err := os.Stat(filepath.Join(sourceDir, path))
+		_, renamedErr := os.Stat(filepath.Join(sourceDir, path+".transferred"))
+		switch policy {
+		case afterDelete:
+			if !os.IsNotExist(err) {
+				t.Errorf("source file is not deleted: %v", err)
+			}
+			if _, err = os.Stat(filepath.Join(sourceDir, "user/project")); !os.IsNotExist(err) {
+				t.Errorf("empty source folder is not removed: %v", err)
+			}
+		case afterRename:
+			if !os.IsNotExist(err) || renamedErr != nil {
+				t.Errorf("source file is not renamed: %v, %v", err, renamedErr)
+			}
+		case afterKeep:
+			if err != nil {
+				t.Errorf("source file is not kept: %v", err)
+			}
+			if _, err = os.Stat(filepath.Join(sourceDir, "user/project/.DS_Store")); err != nil {
+				t.Errorf("read-only source is modified by the default filter: %v", err)
+			}
+			plan, _ := planFileMove(source, dests, dustbin, config, state)
+			for _, action := range plan {
+				if action.Action != planSkip || action.Path != "user/project/.DS_Store" {
+					t.Errorf("kept file is planned again: %v", action)
+				}
+			}
+			os.Remove(filepath.Join(sourceDir, path))
+			FileMove(context.Background(), source, dests, dustbin, "", config, state)
+			if len(state.Kept) != 0 {
+				t.Errorf("removed file is not forgotten: %v", state.Kept)
+			}
+		}
+	}
+}
+
+// readOnlyDirFs fails every write like a read-only share, the tests run as root so file modes don't stop the writes.
+type readOnlyDirFs struct {
+	*LocalDirFs
+}
+
+func readOnlyError(op string, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: syscall.EROFS}
+}
+
+func (fs *readOnlyDirFs) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, readOnlyError("open", name)
+	}
+	return fs.LocalDirFs.OpenFile(name, flag, perm)
+}
+
+func (fs *readOnlyDirFs) Create(path string) (File, error) {
+	return nil, readOnlyError("create", path)
+}
+
+func (fs *readOnlyDirFs) MkdirAll(path string) error {
+	return readOnlyError("mkdir", path)
+}
+
+func (fs *readOnlyDirFs) Remove(path string) error {
+	return readOnlyError("remove", path)
+}
+
+func (fs *readOnlyDirFs) Rename(oldpath string, newpath string) error {
+	return readOnlyError("rename", oldpath)
+}
+
+func (fs *readOnlyDirFs) Move(path string, destroot string) error {
+	return readOnlyError("move", path)
+}
+
+func (fs *readOnlyDirFs) Chmod(path string, mode os.FileMode) error {
+	return readOnlyError("chmod", path)
+}
+
+func TestKeptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	state, _ := LoadTransferState(path)
+	modTime := time.Now()
+	state.addKept("user/project/movie.tiff", &CopyRecord{Size: 10, ModTime: modTime})
+	state.addKept("user/project/movie2.tiff", &CopyRecord{Size: 20, ModTime: modTime})
+	state.setResumeRecord("user/project/movie3.tiff", &ResumeRecord{Target: "user/project/movie3.tiff"})
+	listing := newSourceListing()
+	listing.seen["user"] = true
+	listing.seen["user/project"] = true
+	listing.seen["user/project/movie.tiff"] = true
+	listing.listed["user/project"] = true
+	state.pruneKept(listing)
+
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "movie.tiff") {
+		t.Errorf("kept files are written to the state file: %s", data)
+	}
+	state, err := LoadTransferState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Kept) != 1 || state.Kept["user/project/movie.tiff"] == nil {
+		t.Errorf("unexpected kept files after loading: %v", state.Kept)
+	}
+	// loading doesn't write, a dry run may load the state next to the daemon
+	data, _ = ioutil.ReadFile(path + ".kept")
+	if strings.Count(string(data), "\n") != 3 {
+		t.Errorf("kept file is changed by loading: %s", data)
+	}
+	if err = state.compactJournals(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(path + ".kept")
+	if strings.Count(string(data), "\n") != 1 {
+		t.Errorf("kept file is not compacted: %s", data)
+	}
+}
+
+func TestDustbinJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	state, _ := LoadTransferState(path)
+	config := ExecutionConfig{Retention: RetentionConfig{Days: 14}}
+	copies := &CopyRecord{Size: 10, Sum: "abc", Targets: map[string]string{"": "user/project/movie.tiff"}}
+	state.addDustbinRecord("user/project/movie.tiff", copies, config)
+	state.addDustbinRecord("user/project/movie2.tiff", copies, config)
+	state.removeDustbinRecord("user/project/movie2.tiff")
+	state.setResumeRecord("user/project/frame.tiff", &ResumeRecord{Target: "user/project/frame.tiff"})
+
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "movie") {
+		t.Errorf("dustbin records are written to the state file: %s", data)
+	}
+	state, err := LoadTransferState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Dustbin) != 1 || state.Dustbin["user/project/movie.tiff"] == nil {
+		t.Errorf("unexpected dustbin records after loading: %v", state.Dustbin)
+	}
+	if err = state.compactJournals(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(path + ".dustbin")
+	if strings.Count(string(data), "\n") != 1 {
+		t.Errorf("dustbin journal is not compacted: %s", data)
+	}
+}
+
+func TestPruneRemoved(t *testing.T) {
+	state, _ := LoadTransferState("")
+	state.Failures["user/project/movie.tiff"] = &FailureRecord{Count: 1}
+	state.Failures["user/project/movie2.tiff"] = &FailureRecord{Count: 1}
+	state.Copies["user/other/movie.tiff"] = &CopyRecord{Size: 10}
+	state.setResumeRecord("hpc:user/project/movie2.tiff", &ResumeRecord{Target: "user/project/movie2.tiff"})
+	listing := newSourceListing()
+	listing.seen["user"] = true
+	listing.seen["user/project"] = true
+	listing.seen["user/project/movie.tiff"] = true
+	listing.listed["."] = true
+	listing.listed["user"] = true
+	listing.listed["user/project"] = true
+	if !state.pruneRemoved(listing, []*destination{{name: "hpc"}}) {
+		t.Errorf("resume record of a removed file is not marked stale")
+	}
+	if len(state.Failures) != 1 || state.Failures["user/project/movie.tiff"] == nil {
+		t.Errorf("unexpected failures: %v", state.Failures)
+	}
+	if len(state.Copies) != 0 {
+		t.Errorf("copies of a removed file are not forgotten: %v", state.Copies)
+	}
+	if record := state.resumeRecord("hpc:user/project/movie2.tiff"); record == nil || !record.Stale {
+		t.Errorf("unexpected resume record: %v", record)
+	}
+}
+
+func TestCleanPartialFiles(t *testing.T) {
+	destDir := t.TempDir()
+	chunked := filepath.Join(destDir, "user/project", partialPath("movie.tiff"))
+	resumable := filepath.Join(destDir, "user/project", partialPath("movie2.tiff"))
+	createTestFile(t, chunked, "half")
+	createTestFile(t, resumable, "half")
+	state, _ := LoadTransferState("")
+	state.setResumeRecord("user/project/movie.tiff", &ResumeRecord{Target: "user/project/movie.tiff", Stale: true})
+	state.setResumeRecord("user/project/movie2.tiff", &ResumeRecord{Target: "user/project/movie2.tiff"})
+	cleanPartialFiles(&destination{DirFs: &LocalDirFs{DirFsBase{Path: destDir}}}, state)
+	if _, err := os.Stat(chunked); !os.IsNotExist(err) {
+		t.Errorf("partial file of a chunked upload is not removed: %v", err)
+	}
+	if _, err := os.Stat(resumable); err != nil {
+		t.Errorf("resumable partial file is removed: %v", err)
+	}
+	if len(state.Resume) != 1 {
+		t.Errorf("unexpected resume records: %v", state.Resume)
+	}
+}
+
+func TestFileMoveResume(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		sourceDir := t.TempDir()
+		destDir := t.TempDir()
+		dustbin := t.TempDir()
+		path := "user/project/dataset/movie.tiff"
+		createTestFile(t, filepath.Join(sourceDir, path), "abcdefghij")
+		// the partial file doesn't match the source, so it's only kept if the prefix is not verified
+		createTestFile(t, filepath.Join(destDir, partialPath(path)), "ABCDE")
+		info, err := os.Stat(filepath.Join(sourceDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, _ := LoadTransferState("")
+		state.setResumeRecord(path, &ResumeRecord{Target: path, Size: info.Size(), ModTime: info.ModTime()})
+		source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+		dest := &LocalDirFs{DirFsBase{Path: destDir}}
+		FileMove(context.Background(), source, []*destination{{DirFs: dest}}, dustbin, "", ExecutionConfig{StartLevel: 3, Checksum: checksumNone, ResumeVerify: verify}, state)
+
+		data, err := ioutil.ReadFile(filepath.Join(destDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "ABCDEfghij"
+		if verify {
+			expected = "abcdefghij"
+		}
+		if string(data) != expected {
+			t.Errorf("unexpected destination content with resume-verify %v: %s", verify, string(data))
+		}
+		if state.resumeRecord(path) != nil {
+			t.Errorf("resume record is not removed after the transfer")
+		}
+	}
+}
+
+func TestFileMoveStableScans(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	dustbin := t.TempDir()
+	path := "user/project/dataset/movie.tiff"
+	createTestFile(t, filepath.Join(sourceDir, path), "movie data")
+	state, _ := LoadTransferState("")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dest := &LocalDirFs{DirFsBase{Path: destDir}}
+	config := ExecutionConfig{StartLevel: 3, StableScans: 1}
+
+	FileMove(context.Background(), source, []*destination{{DirFs: dest}}, dustbin, "", config, state)
+	if _, err := os.Stat(filepath.Join(destDir, path)); !os.IsNotExist(err) {
+		t.Errorf("file is transferred before it's stable: %v", err)
+	}
+	FileMove(context.Background(), source, []*destination{{DirFs: dest}}, dustbin, "", config, state)
+	if _, err := os.Stat(filepath.Join(destDir, path)); err != nil {
+		t.Errorf("stable file is not transferred: %v", err)
+	}
+}
+
+func TestFileMoveDatasetMarker(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	dustbin := t.TempDir()
+	path := "user/project/dataset/frames/movie.tiff"
+	createTestFile(t, filepath.Join(sourceDir, path), "movie data")
+	state, _ := LoadTransferState("")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dest := &LocalDirFs{DirFsBase{Path: destDir}}
+	config := ExecutionConfig{StartLevel: 3, DatasetMarker: ".done", MarkerToDest: true}
+
+	FileMove(context.Background(), source, []*destination{{DirFs: dest}}, dustbin, "", config, state)
+	if _, err := os.Stat(filepath.Join(destDir, path)); !os.IsNotExist(err) {
+		t.Errorf("dataset is transferred before it's complete: %v", err)
+	}
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset/.done"), "")
+	FileMove(context.Background(), source, []*destination{{DirFs: dest}}, dustbin, "", config, state)
+	if _, err := os.Stat(filepath.Join(destDir, path)); err != nil {
+		t.Errorf("complete dataset is not transferred: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "user/project/dataset/.done")); err != nil {
+		t.Errorf("marker is not transferred: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, "user/project/dataset")); !os.IsNotExist(err) {
+		t.Errorf("dataset folder is not removed from the source: %v", err)
+	}
+}
+
+func TestFileMoveStageDatasets(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	dustbin := t.TempDir()
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset/frames/movie.tiff"), "new movie")
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset2/frames/movie.tiff"), "movie 2")
+	// dataset was published before, the staged files are merged into it
+	createTestFile(t, filepath.Join(destDir, "user/project/dataset/frames/movie.tiff"), "old movie")
+	state, _ := LoadTransferState("")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dest := &LocalDirFs{DirFsBase{Path: destDir}}
+	FileMove(context.Background(), source, []*destination{{DirFs: dest}}, dustbin, "", ExecutionConfig{StartLevel: 3, StageDatasets: true}, state)
+
+	expected := map[string]string{
+		"user/project/dataset/frames/movie.tiff":    "old movie",
+		"user/project/dataset/frames/movie(1).tiff": "new movie",
+		"user/project/dataset2/frames/movie.tiff":   "movie 2",
+	}
+	for path, content := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(destDir, path))
+		if err != nil {
+			t.Error(err)
+		} else if string(data) != content {
+			t.Errorf("unexpected content of %s: %s", path, string(data))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(destDir, ".incoming/user/project/dataset")); !os.IsNotExist(err) {
+		t.Errorf("staged dataset is not removed: %v", err)
+	}
+}
+
+func TestFileMoveQuarantine(t *testing.T) {
+	sourceDir := t.TempDir()
+	quarantine := t.TempDir()
+	path := "user/project/dataset/movie.tiff"
+	createTestFile(t, filepath.Join(sourceDir, path), "movie data")
+	// the destination is a file, so every transfer fails
+	destFile := filepath.Join(t.TempDir(), "dest")
+	createTestFile(t, destFile, "")
+	state, _ := LoadTransferState("")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dest := &LocalDirFs{DirFsBase{Path: destFile}}
+	FileMove(context.Background(), source, []*destination{{DirFs: dest}}, t.TempDir(), quarantine, ExecutionConfig{StartLevel: 3, MaxFailures: 1}, state)
+
+	if _, err := os.Stat(filepath.Join(quarantine, path)); err != nil {
+		t.Errorf("file is not moved to the quarantine folder: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(quarantine, path+".error.txt")); err != nil {
+		t.Errorf("error file is not written: %v", err)
+	}
+}
+
+// growingDirFs changes the modification time of a file after it's opened, like a file that is still written.
+type growingDirFs struct {
+	*LocalDirFs
+}
+
+func (fs *growingDirFs) Open(name string) (File, error) {
+	file, err := fs.LocalDirFs.Open(name)
+	if err == nil {
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(fs.abspath(name), later, later)
+	}
+	return file, err
+}
+
+func TestFileMoveChangedDuringTransfer(t *testing.T) {
+	sourceDir := t.TempDir()
+	quarantine := t.TempDir()
+	path := "user/project/dataset/movie.tiff"
+	createTestFile(t, filepath.Join(sourceDir, path), "movie data")
+	state, _ := LoadTransferState("")
+	source := &growingDirFs{&LocalDirFs{DirFsBase{Path: sourceDir}}}
+	dest := &LocalDirFs{DirFsBase{Path: t.TempDir()}}
+	result := FileMove(context.Background(), source, []*destination{{DirFs: dest}}, t.TempDir(), quarantine, ExecutionConfig{StartLevel: 3, MaxFailures: 1}, state)
+	if result.Failed != 0 || result.Pending != 1 {
+		t.Errorf("changed file is not left for a later scan: %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, path)); err != nil {
+		t.Errorf("changed file is moved: %v", err)
+	}
+	if len(state.Failures) != 0 {
+		t.Errorf("changed file is counted as a failure: %v", state.Failures)
+	}
+}
+
+// shrinkingDirFs truncates a file after it's opened, like a file that is written again.
+type shrinkingDirFs struct {
+	*LocalDirFs
+}
+
+func (fs *shrinkingDirFs) Open(name string) (File, error) {
+	file, err := fs.LocalDirFs.Open(name)
+	if err == nil {
+		os.Truncate(fs.abspath(name), 3)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(fs.abspath(name), later, later)
+	}
+	return file, err
+}
+
+// chunkedDirFs uploads every file in two parallel streams.
+type chunkedDirFs struct {
+	*LocalDirFs
+}
+
+func (fs *chunkedDirFs) uploadStreams(size int64) int {
+	return 2
+}
+
+func TestFileMoveShrunkDuringChunkedUpload(t *testing.T) {
+	sourceDir := t.TempDir()
+	path := "user/project/dataset/movie.tiff"
+	createTestFile(t, filepath.Join(sourceDir, path), "movie data")
+	state, _ := LoadTransferState("")
+	source := &shrinkingDirFs{&LocalDirFs{DirFsBase{Path: sourceDir}}}
+	dest := &chunkedDirFs{&LocalDirFs{DirFsBase{Path: t.TempDir()}}}
+	result := FileMove(context.Background(), source, []*destination{{DirFs: dest}}, t.TempDir(), "", ExecutionConfig{StartLevel: 3}, state)
+	if result.Failed != 0 || result.Pending != 1 {
+		t.Errorf("shrunk file is not left for a later scan: %+v", result)
+	}
+	if len(state.Failures) != 0 {
+		t.Errorf("shrunk file is counted as a failure: %v", state.Failures)
+	}
+}
+
+// stalledReader blocks until it's closed, like a read from a broken connection.
+type stalledReader struct {
+	closed chan struct{}
+}
+
+func (r *stalledReader) Read(p []byte) (int, error) {
+	<-r.closed
+	return 0, io.ErrClosedPipe
+}
+
+func TestFileMoveOnce(t *testing.T) {
+	sourceDir := t.TempDir()
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset/movie.tiff"), "movie data")
+	config := &AppConfig{Jobs: []JobConfig{{
+		Source:    DirFsConfig{Type: Local, Path: sourceDir},
+		Dests:     []DestinationConfig{{DirFsConfig: DirFsConfig{Type: Local, Path: t.TempDir()}}},
+		Dustbin:   t.TempDir(),
+		Execution: ExecutionConfig{StartLevel: 3},
+	}}}
+	if code := FileMoveOnce(context.Background(), config); code != exitTransferred {
+		t.Errorf("unexpected exit code %d after transfer", code)
+	}
+	if code := FileMoveOnce(context.Background(), config); code != exitNothing {
+		t.Errorf("unexpected exit code %d without files", code)
+	}
+	// a dataset without its marker is not ready yet
+	config.Jobs[0].Execution.DatasetMarker = "done.txt"
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset2/movie.tiff"), "movie data")
+	if code := FileMoveOnce(context.Background(), config); code != exitPending {
+		t.Errorf("unexpected exit code %d with an incomplete dataset", code)
+	}
+	config.Jobs[0].Execution = ExecutionConfig{StartLevel: 3, StableScans: 2}
+	if code := FileMoveOnce(context.Background(), config); code != exitFailed {
+		t.Errorf("stable-scans is accepted with -once, the exit code is %d", code)
+	}
+	config.Jobs[0].Execution = ExecutionConfig{StartLevel: 3}
+	os.RemoveAll(filepath.Join(sourceDir, "user/project/dataset2"))
+	// the destination is a file, so no folder can be created in it
+	config.Jobs[0].Dests[0].Path = filepath.Join(t.TempDir(), "file")
+	createTestFile(t, config.Jobs[0].Dests[0].Path, "")
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset/movie2.tiff"), "movie data")
+	if code := FileMoveOnce(context.Background(), config); code != exitFailed {
+		t.Errorf("unexpected exit code %d after failure", code)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset/movie.tiff"), "movie data")
+	createTestFile(t, filepath.Join(sourceDir, "user/project/dataset/.DS_Store"), "")
+	createTestFile(t, filepath.Join(destDir, "user/project/dataset/movie.tiff"), "old movie")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dest := &LocalDirFs{DirFsBase{Path: destDir}}
+	state, _ := LoadTransferState("")
+	plan, err := planFileMove(source, []*destination{{DirFs: dest, root: destDir}}, "/dustbin", ExecutionConfig{StartLevel: 3}, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PlannedAction{
+		{Action: planRemove, Path: "user/project/dataset/.DS_Store"},
+		{Action: planTransfer, Path: "user/project/dataset/movie.tiff", Target: filepath.Join(destDir, "user/project/dataset/movie(1).tiff"), Dustbin: "/dustbin/user/project/dataset/movie.tiff"},
+		{Action: planRemoveDir, Path: "user/project/dataset"},
+	}
+	if len(plan) != len(expected) {
+		t.Fatalf("unexpected plan: %v", plan)
+	}
+	for i := range expected {
+		if plan[i] != expected[i] {
+			t.Errorf("unexpected action %v, expected %v", plan[i], expected[i])
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, "user/project/dataset/.DS_Store")); err != nil {
+		t.Errorf("dry run removed a file: %v", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	createTestFile(t, path, "source:\n  type: local\n  path: "+dir+"\ndest:\n  type: local\n  path: "+dir+"\nstate-file: \"\"\n")
+	config, err := LoadAppConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := newMoveJob(config.Jobs[0], nil, newConnectionPool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceFs := job.sourceFs
+
+	reloader := newConfigReloader(path, "")
+	createTestFile(t, path, "execution:\n  checksum: unknown\n")
+	reloader.reload()
+	if reloader.take() != nil {
+		t.Errorf("invalid config is accepted")
+	}
+
+	createTestFile(t, path, "source:\n  type: local\n  path: "+dir+"\ndest:\n  type: local\n  path: "+filepath.Join(dir, "dest")+"\nstate-file: \"\"\n")
+	reloader.reload()
+	newConfig := reloader.take()
+	if newConfig == nil {
+		t.Fatal("valid config is not accepted")
+	}
+	if err = job.reconfigure(newConfig.Jobs[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	if job.sourceFs != sourceFs {
+		t.Errorf("unchanged source is created again")
+	}
+	if job.config.Dests[0].Path != filepath.Join(dir, "dest") {
+		t.Errorf("new destination is not applied")
+	}
+}
+
+func TestLoadJobs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	createTestFile(t, path, "jobs:\n- name: krios\n  source:\n    type: local\n    path: /krios\n- name: arctica\n  source:\n    type: local\n    path: /arctica\n")
+	config, err := LoadAppConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Jobs) != 2 || config.Jobs[1].Source.Path != "/arctica" {
+		t.Fatalf("unexpected jobs: %v", config.Jobs)
+	}
+	if config.Jobs[0].StateFile != "tohpc-state-krios.json" {
+		t.Errorf("unexpected state file %s", config.Jobs[0].StateFile)
+	}
+	for _, topLevel := range []string{"execution:\n  workers: 4\n", "quarantine: /quarantine\n", "state-file: state.json\n"} {
+		createTestFile(t, path, topLevel+"jobs:\n- name: krios\n")
+		if _, err = LoadAppConfig(path, ""); err == nil {
+			t.Errorf("top level %sis accepted with jobs", topLevel)
+		}
+	}
+	createTestFile(t, path, "jobs:\n- name: krios\n- name: krios\n")
+	if _, err = LoadAppConfig(path, ""); err == nil {
+		t.Errorf("duplicate job names are accepted")
+	}
+	createTestFile(t, path, "jobs:\n- name: krios\n  execution:\n    after-transfer: delete\n    max-failures: 1\n")
+	if _, err = LoadAppConfig(path, ""); err == nil {
+		t.Errorf("max-failures without quarantine folder is accepted")
+	}
+	createTestFile(t, path, "jobs:\n- name: krios\n  dustbin: /data/dustbin/\n")
+	config, err = LoadAppConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Jobs[0].Quarantine != filepath.FromSlash("/data/quarantine") {
+		t.Errorf("unexpected default quarantine folder %s", config.Jobs[0].Quarantine)
+	}
+	createTestFile(t, path, "jobs:\n- name: krios\n  quarantine: /quarantine\n  execution:\n    after-transfer: delete\n    max-failures: 1\n")
+	if _, err = LoadAppConfig(path, ""); err != nil {
+		t.Errorf("max-failures with quarantine folder is rejected: %v", err)
+	}
+	createTestFile(t, path, "jobs:\n- name: krios\n  execution:\n    after-transfer: keep\n    filters:\n    - pattern: Thumbs.db\n      action: delete\n")
+	if _, err = LoadAppConfig(path, ""); err == nil {
+		t.Errorf("filter that removes files is accepted with the after-transfer policy keep")
+	}
+}
+
+func TestFileMoveJobs(t *testing.T) {
+	destDir := t.TempDir()
+	var jobs []JobConfig
+	for _, name := range []string{"krios", "arctica"} {
+		sourceDir := t.TempDir()
+		createTestFile(t, filepath.Join(sourceDir, "user/project/dataset/movie.tiff"), name)
+		jobs = append(jobs, JobConfig{
+			Name:      name,
+			Source:    DirFsConfig{Type: Local, Path: sourceDir},
+			Dests:     []DestinationConfig{{DirFsConfig: DirFsConfig{Type: Local, Path: filepath.Join(destDir, name)}}},
+			Dustbin:   t.TempDir(),
+			Execution: ExecutionConfig{StartLevel: 3},
+		})
+	}
+	if code := FileMoveOnce(context.Background(), &AppConfig{Jobs: jobs}); code != exitTransferred {
+		t.Errorf("unexpected exit code %d", code)
+	}
+	for _, name := range []string{"krios", "arctica"} {
+		data, err := ioutil.ReadFile(filepath.Join(destDir, name, "user/project/dataset/movie.tiff"))
+		if err != nil || string(data) != name {
+			t.Errorf("file of job %s is not transferred: %v", name, err)
+		}
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	pool := newConnectionPool()
+	krios := DirFsConfig{Type: Local, Path: "/krios"}
+	arctica := DirFsConfig{Type: Local, Path: "/arctica"}
+	kriosCreator, err := pool.acquire(krios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arcticaCreator, err := pool.acquire(arctica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.connections) != 1 {
+		t.Errorf("the jobs don't share the connection")
+	}
+	dirfs, _ := arcticaCreator.create("")
+	if dirfs.(*LocalDirFs).Path != "/arctica" {
+		t.Errorf("unexpected root folder %s", dirfs.(*LocalDirFs).Path)
+	}
+	dirfs, _ = kriosCreator.create("")
+	if dirfs.(*LocalDirFs).Path != "/krios" {
+		t.Errorf("unexpected root folder %s", dirfs.(*LocalDirFs).Path)
+	}
+	pool.release(krios)
+	pool.release(arctica)
+	if len(pool.connections) != 0 {
+		t.Errorf("the connection is not closed after the last job released it")
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	filters, err := compileFilters([]FilterRule{
+		{Pattern: "Thumbs.db", Action: filterDelete},
+		{Pattern: "~$*"},
+		{Pattern: "tmp/", Action: filterDustbin},
+		{Pattern: "/user/**/*.part", OlderThan: 3600},
+		{Pattern: "!keep.part"},
+		{SmallerThan: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	createTestFile(t, filepath.Join(dir, "old.part"), "data")
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "old.part"), old, old)
+	oldInfo, _ := os.Stat(filepath.Join(dir, "old.part"))
+	createTestFile(t, filepath.Join(dir, "new.part"), "data")
+	newInfo, _ := os.Stat(filepath.Join(dir, "new.part"))
+	createTestFile(t, filepath.Join(dir, "empty"), "")
+	emptyInfo, _ := os.Stat(filepath.Join(dir, "empty"))
+	tests := []struct {
+		path   string
+		info   os.FileInfo
+		action string
+	}{
+		{"user/project/Thumbs.db", newInfo, filterDelete},
+		{"user/project/~$report.docx", newInfo, filterSkip},
+		{"user/project/tmp/movie.tiff", newInfo, filterDustbin},
+		{"user/project/dataset/old.part", oldInfo, filterSkip},
+		{"user/project/dataset/new.part", newInfo, ""},
+		{"other/project/old.part", oldInfo, ""},
+		{"user/project/keep.part", oldInfo, ""},
+		{"user/project/empty", emptyInfo, filterSkip},
+		{"user/project/.DS_Store", newInfo, filterDelete},
+		{"user/project/movie.tiff", newInfo, ""},
+	}
+	for _, test := range tests {
+		action := ""
+		if filter := filterFile(filters, test.path, test.info); filter != nil {
+			action = filter.rule.Action
+		}
+		if action != test.action {
+			t.Errorf("unexpected action %q for %s, expected %q", action, test.path, test.action)
+		}
+	}
+	if _, err = compileFilters([]FilterRule{{Pattern: "*.tmp", Action: "archive"}}); err == nil {
+		t.Errorf("unsupported action is accepted")
+	}
+	if _, err = compileFilters([]FilterRule{{}}); err == nil {
+		t.Errorf("rule without pattern, size and age is accepted")
+	}
+}
+
+func TestCopyWithTimeoutStalled(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	state, _ := LoadTransferState("")
+	state.job = "lab"
+	reader := &stalledReader{closed: make(chan struct{})}
+	_, err := copyWithTimeout(context.Background(), ioutil.Discard, reader, time.Second, 0, transferAborter{state: state, path: "movie.tiff", close: func() {
+		close(reader.closed)
+	}})
+	if err != errTransferStalled {
+		t.Errorf("stalled copy is not aborted, the error is: %v", err)
+	}
+	if !strings.Contains(output.String(), "[lab] abort transfer of file movie.tiff") {
+		t.Errorf("abort is not logged for the job and the file: %s", output.String())
+	}
+}
+
+func TestCopyWithTimeoutDropped(t *testing.T) {
+	grace := abortGrace
+	abortGrace = 100 * time.Millisecond
+	defer func() { abortGrace = grace }()
+	// closing the files doesn't stop the read, only dropping the connection does
+	reader := &stalledReader{closed: make(chan struct{})}
+	dropped := false
+	_, err := copyWithTimeout(context.Background(), ioutil.Discard, reader, time.Second, 0, transferAborter{
+		close: func() {},
+		drop: func(reading bool) {
+			dropped = reading
+			close(reader.closed)
+		},
+	})
+	if err != errTransferStalled || !dropped {
+		t.Errorf("copy is not aborted by dropping the connection of the source, the error is: %v", err)
+	}
+	// a hanging write drops the connection of the destination
+	writer := &stalledWriter{closed: make(chan struct{})}
+	dropped = false
+	_, err = copyWithTimeout(context.Background(), writer, strings.NewReader("movie data"), time.Second, 0, transferAborter{
+		close: func() {},
+		drop: func(reading bool) {
+			dropped = !reading
+			close(writer.closed)
+		},
+	})
+	if err != errTransferStalled || !dropped {
+		t.Errorf("copy is not aborted by dropping the connection of the destination, the error is: %v", err)
+	}
+}
+
+func TestCopyWithTimeoutLeftBehind(t *testing.T) {
+	grace := abortGrace
+	abortGrace = 100 * time.Millisecond
+	defer func() { abortGrace = grace }()
+	// a read that hangs in the kernel is stopped neither by closing the files nor by dropping the connection
+	reader := &stalledReader{closed: make(chan struct{})}
+	defer close(reader.closed)
+	_, err := copyWithTimeout(context.Background(), ioutil.Discard, reader, time.Second, 0, transferAborter{
+		close: func() {},
+		drop:  func(reading bool) {},
+	})
+	var leftBehind *leftBehindError
+	if !errors.As(err, &leftBehind) || !errors.Is(err, errTransferStalled) {
+		t.Errorf("hanging copy is not left behind, the error is: %v", err)
+	}
+}
+
+// stalledWriter blocks until it's closed, like a write to a broken connection.
+type stalledWriter struct {
+	closed chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	<-w.closed
+	return 0, io.ErrClosedPipe
+}
+
+func TestCopyChunked(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 3*chunkBufferSize+12345)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	sourcePath := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(sourcePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	targetPath := filepath.Join(dir, "target")
+	target, err := os.Create(targetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	// the first bytes were transferred by an earlier stream copy
+	if _, err := target.Write(content[:100]); err != nil {
+		t.Fatal(err)
+	}
+	written, err := copyChunked(context.Background(), target, source, 100, int64(len(content)), 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(content)-100) {
+		t.Errorf("written %d bytes, expected %d", written, len(content)-100)
+	}
+	result, err := ioutil.ReadFile(targetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != string(content) {
+		t.Errorf("chunked copy doesn't match the source file")
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	office := TimeWindow{Days: []string{"weekdays"}, From: "08:00", To: "18:00"}
+	night := TimeWindow{Days: []string{"fri"}, From: "22:00", To: "06:00"}
+	monday := time.Date(2024, 1, 8, 9, 30, 0, 0, time.Local)
+	saturday := time.Date(2024, 1, 13, 5, 0, 0, 0, time.Local)
+	if !office.contains(monday) || office.contains(monday.Add(9*time.Hour)) || office.contains(saturday.Add(5*time.Hour)) {
+		t.Errorf("office hours window is not correct")
+	}
+	if !night.contains(saturday) || night.contains(saturday.AddDate(0, 0, 1)) {
+		t.Errorf("window over midnight is not correct")
+	}
+	if err := (TimeWindow{From: "25:00"}).validate(); err == nil {
+		t.Errorf("invalid time is accepted")
+	}
+}
+
+func TestTransferWindows(t *testing.T) {
+	windows := TransferWindows{
+		Allowed:   []TimeWindow{{From: "20:00", To: "06:00"}},
+		Blocked:   []TimeWindow{{Days: []string{"sun"}}},
+		Blackouts: []Blackout{{From: "2024-01-09"}},
+	}
+	if err := windows.validate(); err != nil {
+		t.Fatal(err)
+	}
+	monday := time.Date(2024, 1, 8, 12, 0, 0, 0, time.Local)
+	if windows.open(monday) || !windows.open(monday.Add(9*time.Hour)) {
+		t.Errorf("allowed window is not correct")
+	}
+	// tuesday is a blackout, the window of tuesday evening is skipped
+	next, ok := windows.nextOpen(monday.Add(13 * time.Hour))
+	expected := time.Date(2024, 1, 10, 0, 0, 0, 0, time.Local)
+	if !ok || !next.Equal(expected) {
+		t.Errorf("next window opens at %s, expected %s", next, expected)
+	}
+	if windows.open(time.Date(2024, 1, 14, 22, 0, 0, 0, time.Local)) {
+		t.Errorf("blocked window is not correct")
+	}
+}
+
+func TestWaitForWindowLogsJob(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	state, _ := LoadTransferState("")
+	state.job = "lab"
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	windows := TransferWindows{Blocked: []TimeWindow{{}}}
+	if windows.waitForWindow(ctx, state) {
+		t.Errorf("closed window is open")
+	}
+	if !strings.Contains(output.String(), "[lab] outside of the transfer windows") {
+		t.Errorf("wait is not logged for the job: %s", output.String())
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	bucket := newTokenBucket(BandwidthConfig{Limit: 1})
+	reader := &limitedReader{reader: io.LimitReader(zeroReader{}, 1536*1024), buckets: []*tokenBucket{bucket}}
+	start := time.Now()
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("1.5 MB at 1 MB/s took %s", elapsed)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestChangeWatcher(t *testing.T) {
+	dir := t.TempDir()
+	watcher := createChangeWatcher(DirFsConfig{Type: Local, Path: dir, Watch: true}, nil)
+	if watcher == nil {
+		t.Skip("watch mode is not supported")
+	}
+	defer watcher.close()
+	if err := os.Mkdir(filepath.Join(dir, "dataset"), DirFileMode); err != nil {
+		t.Fatal(err)
+	}
+	<-watcher.changes()
+	// the new folder is watched too
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-watcher.changes():
+	default:
+	}
+	createTestFile(t, filepath.Join(dir, "dataset/movie.tiff"), "movie data")
+	select {
+	case <-watcher.changes():
+	case <-time.After(5 * time.Second):
+		t.Errorf("file in new folder is not reported")
+	}
+}
+
+func TestCopyWithTimeoutAborted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &stalledReader{closed: make(chan struct{})}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err := copyWithTimeout(ctx, ioutil.Discard, reader, 0, 0, transferAborter{close: func() {
+		close(reader.closed)
+	}})
+	if err != errTransferAborted {
+		t.Errorf("copy is not aborted, the error is: %v", err)
+	}
+}
+
+func TestFileMoveStopped(t *testing.T) {
+	sourceDir := t.TempDir()
+	path := "user/project/dataset/movie.tiff"
+	createTestFile(t, filepath.Join(sourceDir, path), "movie data")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dest := &LocalDirFs{DirFsBase{Path: t.TempDir()}}
+	state, _ := LoadTransferState("")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result := FileMove(ctx, source, []*destination{{DirFs: dest}}, t.TempDir(), "", ExecutionConfig{StartLevel: 3}, state)
+	if result.Transferred != 0 {
+		t.Errorf("file is transferred after the stop")
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, path)); err != nil {
+		t.Errorf("source file is moved after the stop: %v", err)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unix sockets are not supported")
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+	sdNotify("READY=1")
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("unexpected notification: %s", string(buf[:n]))
+	}
+}
+
+func TestHashFileActivity(t *testing.T) {
+	dir := t.TempDir()
+	createTestFile(t, filepath.Join(dir, "movie.tiff"), "movie data")
+	moveActivity.setWaiting(false)
+	defer moveActivity.setWaiting(true)
+	atomic.StoreInt64(&moveActivity.last, 0)
+	if _, err := hashFile(&LocalDirFs{DirFsBase{Path: dir}}, "movie.tiff", "sha256"); err != nil {
+		t.Fatal(err)
+	}
+	if !moveActivity.alive(time.Minute) {
+		t.Errorf("checksum read doesn't feed the watchdog")
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	if isConnectionError(&os.PathError{Op: "lstat", Path: "dest", Err: syscall.ENOTDIR}) {
+		t.Errorf("file error is classified as connection error")
+	}
+	if !isConnectionError(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}) {
+		t.Errorf("connection reset is not classified as connection error")
+	}
+	if !isConnectionError(errors.Wrap(sftp.ErrSSHFxConnectionLost, "can't open file")) {
+		t.Errorf("lost sftp connection is not classified as connection error")
+	}
+}
+
+// droppingCreator creates a file system whose connection breaks while the folder is read the first time.
+type droppingCreator struct {
+	fs       *LocalDirFs
+	dropDir  string
+	dropped  bool
+	reopened int
+}
+
+type droppingDirFs struct {
+	*LocalDirFs
+	creator *droppingCreator
+}
+
+func (fs *droppingDirFs) ReadDir(path string) ([]os.FileInfo, error) {
+	if path == fs.creator.dropDir && !fs.creator.dropped {
+		fs.creator.dropped = true
+		return nil, io.ErrUnexpectedEOF
+	}
+	return fs.LocalDirFs.ReadDir(path)
+}
+
+func (c *droppingCreator) create(job string) (DirFs, error) {
+	return &droppingDirFs{LocalDirFs: c.fs, creator: c}, nil
+}
+
+func (c *droppingCreator) close() {
+}
+
+func (c *droppingCreator) invalidate(dirfs DirFs) {
+	// only the connection of the failed read is closed
+	if _, ok := dirfs.(*droppingDirFs); ok {
+		c.reopened++
+	}
+}
+
+func TestManagedWalkReconnects(t *testing.T) {
+	dir := t.TempDir()
+	createTestFile(t, filepath.Join(dir, "user/a/movie.tiff"), "a")
+	createTestFile(t, filepath.Join(dir, "user/b/movie.tiff"), "b")
+	creator := &droppingCreator{fs: &LocalDirFs{DirFsBase{Path: dir}}, dropDir: "user/b"}
+	managed := newManagedDirFs(creator, DirFsConfig{}, "")
+	var files []string
+	managed.Walk(func(path string, d fs.DirEntry, level int, err error) error {
+		return nil
+	}, func(path string, info fs.FileInfo, level int, err error) error {
+		files = append(files, path)
+		return nil
+	}, func(path string, d fs.DirEntry, level int, err error) error {
+		if err != nil {
+			t.Errorf("folder %s can't be read: %v", path, err)
+		}
+		return nil
+	})
+	if len(files) != 2 || creator.reopened != 1 {
+		t.Errorf("walk doesn't go on after reconnecting, files: %v, reconnects: %d", files, creator.reopened)
+	}
+}
+
+func TestWalkUnreadableDir(t *testing.T) {
+	source := &LocalDirFs{DirFsBase{Path: filepath.Join(t.TempDir(), "missing")}}
+	var walkErr error
+	source.Walk(func(path string, d fs.DirEntry, level int, err error) error {
+		return nil
+	}, func(path string, info fs.FileInfo, level int, err error) error {
+		return nil
+	}, func(path string, d fs.DirEntry, level int, err error) error {
+		walkErr = err
+		return nil
+	})
+	if !os.IsNotExist(walkErr) {
+		t.Errorf("error of unreadable root folder is not reported: %v", walkErr)
+	}
+}
+
+func TestFileMoveWorkers(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	dustbin := t.TempDir()
+	var paths []string
+	for _, dataset := range []string{"dataset1", "dataset2", "dataset3"} {
+		for _, name := range []string{"a.tiff", "b.tiff", "frames/c.tiff", "frames/d.tiff"} {
+			path := filepath.Join("user/project", dataset, name)
+			createTestFile(t, filepath.Join(sourceDir, path), path)
+			paths = append(paths, path)
+		}
+	}
+	state, _ := LoadTransferState("")
+	source := &LocalDirFs{DirFsBase{Path: sourceDir}}
+	dest := &LocalDirFs{DirFsBase{Path: destDir}}
+	FileMove(context.Background(), source, []*destination{{DirFs: dest}}, dustbin, "", ExecutionConfig{StartLevel: 3, Workers: 4}, state)
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(filepath.Join(destDir, path))
+		if err != nil || string(data) != path {
+			t.Errorf("file %s is not transferred: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, "user/project/dataset1")); !os.IsNotExist(err) {
+		t.Errorf("dataset folder is not removed from the source: %v", err)
+	}
+}
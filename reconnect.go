@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+// isConnectionError reports whether the error is caused by a broken connection,
+// rather than by the file or the operation itself.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, target := range []error{
+		errTransferStalled,
+		errTransferTimeout,
+		sftp.ErrSSHFxConnectionLost,
+		sftp.ErrSSHFxNoConnection,
+		io.ErrUnexpectedEOF,
+		io.ErrClosedPipe,
+		net.ErrClosed,
+		os.ErrDeadlineExceeded,
+		syscall.ECONNRESET,
+		syscall.ECONNABORTED,
+		syscall.ECONNREFUSED,
+		syscall.EPIPE,
+		syscall.ETIMEDOUT,
+		syscall.ENETUNREACH,
+		syscall.EHOSTUNREACH,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	// syscall errors implement net.Error too, so only the errors of network operations are checked
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var transportErr *smb2.TransportError
+	if errors.As(err, &transportErr) {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "use of closed network connection") ||
+		strings.Contains(message, "connection lost")
+}
+
+func (c *DirFsConfig) reconnectAttempts() int {
+	if c.ReconnectAttempts <= 0 {
+		return 3
+	}
+	return c.ReconnectAttempts
+}
+
+func (c *DirFsConfig) healthCheckInterval() time.Duration {
+	if c.HealthCheckInterval <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.HealthCheckInterval) * time.Second
+}
+
+// retry runs the operation, if it fails because of a broken connection,
+// the connection is created again with a backoff and the operation is retried.
+func (m *ManagedDirFs) retry(op func(dirfs DirFs) error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var dirfs DirFs
+		dirfs, err = m.fs()
+		if err == nil {
+			err = op(dirfs)
+		}
+		if attempt >= m.attempts || !isConnectionError(err) {
+			return err
+		}
+		delay := time.Duration(1<<attempt) * time.Second
+		jobLogf(m.job, "connection error: %v, reconnect in %s\n", err, delay)
+		if dirfs != nil {
+			// only the connection the operation used is closed, another goroutine may have replaced it already
+			m.creator.invalidate(dirfs)
+		}
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// mailbox passes the latest value to a loop that waits between two scans,
+// a value that was not taken yet is replaced by the next one.
+type mailbox struct {
+	mutex   sync.Mutex
+	pending interface{}
+	wake    chan struct{} // receives a value when a value is pending
+}
+
+func newMailbox() *mailbox {
+	return &mailbox{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (m *mailbox) put(value interface{}) {
+	m.mutex.Lock()
+	m.pending = value
+	m.mutex.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending value, nil if there is none.
+func (m *mailbox) take() interface{} {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	value := m.pending
+	m.pending = nil
+	return value
+}
+
+// waitContext returns a context for the waits between the scans,
+// it's canceled when ctx is canceled or a value is pending.
+func (m *mailbox) waitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	waitCtx, cancel := context.WithCancel(ctx)
+	if m == nil {
+		return waitCtx, cancel
+	}
+	go func() {
+		select {
+		case <-m.wake:
+			cancel()
+		case <-waitCtx.Done():
+		}
+	}()
+	return waitCtx, cancel
+}
+
+// configReloader reads the config file again when the program receives SIGHUP.
+// The new config is applied by the jobs between two scans.
+type configReloader struct {
+	path    string
+	secret  string // the decryption secret that was entered at the start
+	configs *mailbox
+}
+
+func newConfigReloader(path string, secret string) *configReloader {
+	return &configReloader{
+		path:    path,
+		secret:  secret,
+		configs: newMailbox(),
+	}
+}
+
+// reload reads and validates the config file, if it's invalid the current config is kept.
+func (r *configReloader) reload() {
+	config, err := LoadAppConfig(r.path, r.secret)
+	if err != nil {
+		log.Printf("can't reload config, keep the current config, the error is %v\n", err)
+		return
+	}
+	log.Printf("config reloaded, it's applied after the current scan\n")
+	r.configs.put(config)
+}
+
+// take returns the pending config, nil if there is none.
+func (r *configReloader) take() *AppConfig {
+	if r == nil {
+		return nil
+	}
+	config, _ := r.configs.take().(*AppConfig)
+	return config
+}
+
+// waitContext returns a context that is canceled when ctx is canceled or a new config is pending.
+func (r *configReloader) waitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r == nil {
+		return (*mailbox)(nil).waitContext(ctx)
+	}
+	return r.configs.waitContext(ctx)
+}
+
+// jobUpdate is a reloaded config of a running job.
+type jobUpdate struct {
+	config    JobConfig
+	bandwidth *tokenBucket // global bandwidth limit of all jobs
+}
+
+// dispatchReloads passes the reloaded configs to the running jobs until ctx is canceled.
+// Jobs that are added or removed are only started or stopped after a restart.
+func dispatchReloads(ctx context.Context, reloader *configReloader, jobs map[string]*mailbox) {
+	for {
+		waitCtx, cancel := reloader.waitContext(ctx)
+		<-waitCtx.Done()
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		config := reloader.take()
+		if config == nil {
+			continue
+		}
+		bandwidth := newTokenBucket(config.Bandwidth)
+		reloaded := make(map[string]bool)
+		for _, job := range config.Jobs {
+			reloaded[job.Name] = true
+			updates, ok := jobs[job.Name]
+			if !ok {
+				log.Printf("job %s was added, it's started after a restart\n", job.Name)
+				continue
+			}
+			updates.put(jobUpdate{config: job, bandwidth: bandwidth})
+		}
+		for name := range jobs {
+			if !reloaded[name] {
+				log.Printf("job %s was removed, it's stopped after a restart\n", name)
+			}
+		}
+	}
+}
+
+// reconfigure applies a reloaded config to the job. The connections to the source and the destinations
+// are only acquired again if their settings changed. If the new config can't be applied, the job is unchanged.
+func (j *moveJob) reconfigure(config JobConfig, bandwidth *tokenBucket) error {
+	// the connections acquired for the new config, they are released if it can't be applied
+	var acquired []DirFsConfig
+	fail := func(err error) error {
+		for _, acquiredConfig := range acquired {
+			j.pool.release(acquiredConfig)
+		}
+		return err
+	}
+	sourceFs := j.sourceFs
+	if config.Source != j.config.Source {
+		creator, err := j.pool.acquire(config.Source)
+		if err != nil {
+			return errors.Wrap(err, "can't create source fs creator")
+		}
+		acquired = append(acquired, config.Source)
+		sourceFs = newManagedDirFs(creator, config.Source, config.Name)
+	}
+	dests := make([]*destination, len(config.Dests))
+	var newDests []*destination
+	for i, destConfig := range config.Dests {
+		if index := indexOfDest(j.config.Dests, destConfig); index >= 0 {
+			dests[i] = j.dests[index]
+			continue
+		}
+		dest, err := acquireDestination(destConfig, j.pool, config.Name)
+		if err != nil {
+			return fail(err)
+		}
+		acquired = append(acquired, destConfig.DirFsConfig)
+		dests[i] = dest
+		newDests = append(newDests, dest)
+	}
+	state := j.state
+	if config.StateFile != j.config.StateFile {
+		var err error
+		state, err = loadJobState(config)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	state.setBandwidth(bandwidth, newTokenBucket(config.Execution.Bandwidth))
+	if sourceFs != j.sourceFs {
+		state.logf("source config changed, reconnect to the source\n")
+		j.pool.release(j.config.Source)
+	}
+	for _, destConfig := range j.config.Dests {
+		if indexOfDest(config.Dests, destConfig) < 0 {
+			j.pool.release(destConfig.DirFsConfig)
+		}
+	}
+	for _, dest := range newDests {
+		state.logf("dest config changed, reconnect to the %s\n", dest.label())
+		cleanDestination(dest, state)
+	}
+	j.config = config
+	j.sourceFs = sourceFs
+	j.dests = dests
+	j.state = state
+	return nil
+}
+
+// indexOfDest returns the index of the destination config in dests, -1 if it's not found.
+func indexOfDest(dests []DestinationConfig, config DestinationConfig) int {
+	for i, dest := range dests {
+		if dest == config {
+			return i
+		}
+	}
+	return -1
+}
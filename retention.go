@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetentionConfig purges the files from the dustbin after their copies on the destinations were verified again.
+type RetentionConfig struct {
+	Days     int  // files are purged this number of days after they were moved to the dustbin, 0 keeps them forever
+	Interval int  // seconds between two purges, default is 3600
+	DryRun   bool `yaml:"dry-run"` // only log the files that would be purged
+}
+
+func (c RetentionConfig) enabled() bool {
+	return c.Days > 0
+}
+
+func (c RetentionConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+func (c RetentionConfig) period() time.Duration {
+	return time.Duration(c.Days) * 24 * time.Hour
+}
+
+// DustbinRecord describes a file in the dustbin and the copies it can be verified with.
+type DustbinRecord struct {
+	Moved    time.Time         `json:"moved"`    // time the file was moved to the dustbin
+	Size     int64             `json:"size"`     // size of the file
+	Checksum string            `json:"checksum"` // checksum algorithm
+	Sum      string            `json:"sum"`      // checksum of the file
+	Targets  map[string]string `json:"targets"`  // path of the copy by destination name
+}
+
+// errDustbinFileGone is returned if the file was removed from the dustbin by someone else.
+var errDustbinFileGone = errors.New("file is not in the dustbin any more")
+
+// addDustbinRecord records the file that was moved to the dustbin.
+func (s *TransferState) addDustbinRecord(path string, copies *CopyRecord, config ExecutionConfig) {
+	record := &DustbinRecord{
+		Moved:    time.Now(),
+		Size:     copies.Size,
+		Checksum: config.checksum(),
+		Sum:      copies.Sum,
+		Targets:  make(map[string]string),
+	}
+	for dest, target := range copies.Targets {
+		record.Targets[dest] = publishedPath(target, config)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Dustbin[path] = record
+	if err := appendJournal(s.journalPath(dustbinJournal), dustbinEntry{Path: path, Record: record}); err != nil {
+		s.logf("can't save dustbin records, the error is:\n%v", err)
+	}
+}
+
+func (s *TransferState) removeDustbinRecord(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.Dustbin, path)
+	if err := appendJournal(s.journalPath(dustbinJournal), dustbinEntry{Path: path}); err != nil {
+		s.logf("can't save dustbin records, the error is:\n%v", err)
+	}
+}
+
+// dustbinEntry is a line of the journal of the dustbin records.
+type dustbinEntry struct {
+	Path   string         `json:"path"`
+	Record *DustbinRecord `json:"record,omitempty"` // nil if the file left the dustbin
+}
+
+// loadDustbin replays the journal of the dustbin records.
+func (s *TransferState) loadDustbin() error {
+	return s.readJournal(s.journalPath(dustbinJournal), func(line []byte) error {
+		var entry dustbinEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		if entry.Record == nil {
+			delete(s.Dustbin, entry.Path)
+		} else {
+			s.Dustbin[entry.Path] = entry.Record
+		}
+		return nil
+	})
+}
+
+// dustbinEntries returns the current dustbin records, to compact the journal.
+func (s *TransferState) dustbinEntries() []interface{} {
+	var entries []interface{}
+	for path, record := range s.Dustbin {
+		entries = append(entries, dustbinEntry{Path: path, Record: record})
+	}
+	return entries
+}
+
+// expiredDustbinRecords returns the records of the files whose retention period is over.
+func (s *TransferState) expiredDustbinRecords(config RetentionConfig, now time.Time) map[string]DustbinRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expired := make(map[string]DustbinRecord)
+	for path, record := range s.Dustbin {
+		if now.Sub(record.Moved) >= config.period() {
+			expired[path] = *record
+		}
+	}
+	return expired
+}
+
+// publishedPath returns the path of a staged file after its dataset was published.
+func publishedPath(target string, config ExecutionConfig) string {
+	if !config.stagingMode() {
+		return target
+	}
+	rel, err := filepath.Rel(config.stagingDir(), target)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return target
+	}
+	return rel
+}
+
+// verifyDustbinFile checks that the file in the dustbin is unchanged and every recorded copy still exists
+// on its destination with the recorded checksum. An error is returned if the file can't be verified.
+func verifyDustbinFile(dustbin DirFs, dests []*destination, path string, record DustbinRecord) error {
+	info, err := dustbin.Lstat(path)
+	if os.IsNotExist(err) {
+		return errDustbinFileGone
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() != record.Size {
+		return errors.New("the file in the dustbin was changed")
+	}
+	if record.Sum == "" || len(record.Targets) == 0 {
+		return errors.New("no verified copy was recorded")
+	}
+	for name, target := range record.Targets {
+		dest := destinationByName(dests, name)
+		if dest == nil {
+			return errors.Errorf("the destination %s is not configured", name)
+		}
+		targetInfo, err := dest.Lstat(target)
+		if err != nil {
+			return errors.Wrapf(err, "can't find the copy on the %s", dest.label())
+		}
+		if targetInfo.Size() != record.Size {
+			return errors.Errorf("the copy on the %s has another size", dest.label())
+		}
+		sum, err := hashFile(dest, target, record.Checksum)
+		if err != nil {
+			return errors.Wrapf(err, "can't compute checksum of the copy on the %s", dest.label())
+		}
+		if sum != record.Sum {
+			return errors.Errorf("the copy on the %s doesn't match the %s checksum", dest.label(), record.Checksum)
+		}
+	}
+	return nil
+}
+
+func destinationByName(dests []*destination, name string) *destination {
+	for _, dest := range dests {
+		if dest.name == name {
+			return dest
+		}
+	}
+	return nil
+}
+
+// purgeDustbin removes the files whose retention period is over from the dustbin, after their copies
+// were verified again. Files that can't be verified are kept. In dry run mode the files are only logged.
+func purgeDustbin(ctx context.Context, dustbin DirFs, dests []*destination, config RetentionConfig, state *TransferState) {
+	purged := 0
+	for path, record := range state.expiredDustbinRecords(config, time.Now()) {
+		if ctx.Err() != nil {
+			return
+		}
+		err := verifyDustbinFile(dustbin, dests, path, record)
+		if err == errDustbinFileGone {
+			state.removeDustbinRecord(path)
+			continue
+		}
+		if err != nil {
+			state.logf("keep file %s in the dustbin, it can't be verified, the error is %v\n", path, err)
+			continue
+		}
+		if config.DryRun {
+			state.logf("dry run, file %s would be purged from the dustbin\n", path)
+			continue
+		}
+		err = dustbin.Remove(path)
+		if err != nil {
+			state.logf("can't purge file %s from the dustbin, the error is %v\n", path, err)
+			continue
+		}
+		state.removeDustbinRecord(path)
+		removeEmptyParents(dustbin, path)
+		purged++
+	}
+	if purged > 0 {
+		state.logf("%d files purged from the dustbin\n", purged)
+	}
+}
+
+// planDustbinPurge returns the files the purge of the dustbin would remove, and the files it would keep
+// because they can't be verified. Nothing is removed and the state is not changed.
+func planDustbinPurge(dustbin DirFs, dests []*destination, dustbinPath string, config RetentionConfig, state *TransferState) []PlannedAction {
+	expired := state.expiredDustbinRecords(config, time.Now())
+	paths := make([]string, 0, len(expired))
+	for path := range expired {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var plan []PlannedAction
+	for _, path := range paths {
+		err := verifyDustbinFile(dustbin, dests, path, expired[path])
+		switch {
+		case err == errDustbinFileGone:
+		case err != nil:
+			plan = append(plan, PlannedAction{Action: planSkip, Path: filepath.Join(dustbinPath, path), Reason: "kept in the dustbin, " + err.Error()})
+		default:
+			plan = append(plan, PlannedAction{Action: planPurge, Path: filepath.Join(dustbinPath, path)})
+		}
+	}
+	return plan
+}
+
+// removeEmptyParents removes the folders of the path as long as they are empty.
+func removeEmptyParents(dirfs DirFs, path string) {
+	for dir := filepath.Dir(path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if dirfs.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// dustbinConfig returns the config of the dustbin of the job, it's a folder on the source.
+func (c *JobConfig) dustbinConfig() DirFsConfig {
+	config := c.Source
+	config.Path = c.Dustbin
+	config.Watch = false
+	return config
+}
+
+// purgeJobDustbin purges the dustbin of the job once. It acquires its own connections from the pool,
+// so a reloaded config doesn't close them while the purge runs.
+func purgeJobDustbin(ctx context.Context, config JobConfig, pool *connectionPool, state *TransferState) {
+	dustbinCreator, err := pool.acquire(config.dustbinConfig())
+	if err != nil {
+		state.logf("can't purge the dustbin, the error is %v\n", err)
+		return
+	}
+	defer pool.release(config.dustbinConfig())
+	var dests []*destination
+	for i, destConfig := range config.Dests {
+		dest, err := acquireDestination(destConfig, pool, config.Name)
+		if err != nil {
+			releaseDestinations(config.Dests[:i], pool)
+			state.logf("can't purge the dustbin, the error is %v\n", err)
+			return
+		}
+		dests = append(dests, dest)
+	}
+	defer releaseDestinations(config.Dests, pool)
+	purgeDustbin(ctx, newManagedDirFs(dustbinCreator, config.dustbinConfig(), config.Name), dests, config.Execution.Retention, state)
+}
+
+// dustbinPurger runs the purges of the dustbin of a job in the background, one at a time.
+type dustbinPurger struct {
+	last    time.Time
+	running int32
+	wg      sync.WaitGroup
+}
+
+// start purges the dustbin in the background if the retention is enabled,
+// the interval elapsed since the last purge and no purge is running.
+func (p *dustbinPurger) start(ctx context.Context, config JobConfig, pool *connectionPool, state *TransferState) {
+	retention := config.Execution.Retention
+	if !retention.enabled() || time.Since(p.last) < retention.interval() {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		return
+	}
+	p.last = time.Now()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer atomic.StoreInt32(&p.running, 0)
+		purgeJobDustbin(ctx, config, pool, state)
+	}()
+}
+
+// wait waits for the running purge.
+func (p *dustbinPurger) wait() {
+	p.wg.Wait()
+}
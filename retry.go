@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// FailureRecord counts the failed transfers of a source file.
+type FailureRecord struct {
+	Count        int       `json:"count"`
+	FirstFailure time.Time `json:"first-failure"`
+	LastFailure  time.Time `json:"last-failure"`
+	LastError    string    `json:"last-error"`
+	NextAttempt  time.Time `json:"next-attempt"`
+}
+
+// retryDelay returns the backoff after the given number of failures,
+// it doubles with every failure up to the maximum.
+func (c ExecutionConfig) retryDelay(failures int) time.Duration {
+	base := time.Duration(c.RetrySeconds) * time.Second
+	if base <= 0 {
+		base = 5 * time.Second
+	}
+	maxDelay := time.Duration(c.RetryMaxSeconds) * time.Second
+	if maxDelay <= 0 {
+		maxDelay = time.Hour
+	}
+	delay := base
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// inBackoff reports whether the file failed recently and must not be retried yet.
+func (s *TransferState) inBackoff(path string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.Failures[path]
+	return ok && time.Now().Before(record.NextAttempt)
+}
+
+// recordFailure counts the failure of the file and returns the record.
+func (s *TransferState) recordFailure(path string, err error, config ExecutionConfig) FailureRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	record, ok := s.Failures[path]
+	if !ok {
+		record = &FailureRecord{
+			FirstFailure: now,
+		}
+		s.Failures[path] = record
+	}
+	record.Count++
+	record.LastFailure = now
+	record.LastError = err.Error()
+	record.NextAttempt = now.Add(config.retryDelay(record.Count))
+	if err := s.save(); err != nil {
+		s.logf("can't save transfer state, the error is:\n%v", err)
+	}
+	return *record
+}
+
+// clearFailures forgets the failures of the file.
+func (s *TransferState) clearFailures(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.Failures[path]; !ok {
+		return
+	}
+	delete(s.Failures, path)
+	if err := s.save(); err != nil {
+		s.logf("can't save transfer state, the error is:\n%v", err)
+	}
+}
+
+// handleFailure counts a failed transfer, after max-failures failures the file is moved to the quarantine folder.
+func handleFailure(source DirFs, quarantine string, path string, err error, config ExecutionConfig, state *TransferState) {
+	record := state.recordFailure(path, err, config)
+	if config.MaxFailures <= 0 || record.Count < config.MaxFailures {
+		state.logf("transfer of file %s failed %d times, retry after %s\n", path, record.Count, record.NextAttempt.Format(time.RFC3339))
+		return
+	}
+	err = quarantineFile(source, quarantine, path, record)
+	if err != nil {
+		state.logf("can't move file %s to the quarantine folder, the error is:\n%v", path, err)
+		return
+	}
+	state.logf("transfer of file %s failed %d times, it's moved to the quarantine folder %s\n", path, record.Count, quarantine)
+	state.clearFailures(path)
+}
+
+// quarantineFile moves the file to the quarantine folder, and writes a text file next to it that explains the last error.
+func quarantineFile(source DirFs, quarantine string, path string, record FailureRecord) error {
+	err := source.MkdirAllAbs(quarantine, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = source.Move(path, quarantine)
+	if err != nil {
+		return err
+	}
+	sidecar, err := source.CreateAbs(quarantine, path+".error.txt")
+	if err != nil {
+		return err
+	}
+	defer sidecar.Close()
+	_, err = fmt.Fprintf(sidecar, "file: %s\nfailures: %d\nfirst failure: %s\nlast failure: %s\nlast error: %s\n",
+		path, record.Count, record.FirstFailure.Format(time.RFC3339), record.LastFailure.Format(time.RFC3339), record.LastError)
+	if err != nil {
+		return err
+	}
+	return sidecar.Close()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeWindow is a recurring period of the week, like 08:00 to 18:00 on weekdays.
+type TimeWindow struct {
+	Days []string // mon, tue, wed, thu, fri, sat, sun, weekdays or weekend, empty means every day
+	From string   // start time as HH:MM, empty means 00:00
+	To   string   // end time as HH:MM, empty means 24:00, a time before the start time ends on the next day
+}
+
+var weekdayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekend":  {time.Saturday, time.Sunday},
+}
+
+// parseClock parses a time of day as HH:MM and returns the minutes since midnight.
+func parseClock(value string, empty int) (int, error) {
+	if value == "" {
+		return empty, nil
+	}
+	var hour, minute int
+	_, err := fmt.Sscanf(value, "%d:%d", &hour, &minute)
+	if err != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, errors.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return hour*60 + minute, nil
+}
+
+func (w TimeWindow) validate() error {
+	for _, day := range w.Days {
+		if _, ok := weekdayNames[strings.ToLower(day)]; !ok {
+			return errors.Errorf("invalid day %q", day)
+		}
+	}
+	if _, err := parseClock(w.From, 0); err != nil {
+		return err
+	}
+	_, err := parseClock(w.To, 24*60)
+	return err
+}
+
+// hasDay reports whether the window starts on the weekday.
+func (w TimeWindow) hasDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		for _, d := range weekdayNames[strings.ToLower(name)] {
+			if d == day {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contains reports whether the time is inside the window, the window must be valid.
+func (w TimeWindow) contains(t time.Time) bool {
+	from, _ := parseClock(w.From, 0)
+	to, _ := parseClock(w.To, 24*60)
+	minute := t.Hour()*60 + t.Minute()
+	if from < to {
+		return w.hasDay(t.Weekday()) && minute >= from && minute < to
+	}
+	// the window ends on the next day
+	yesterday := t.AddDate(0, 0, -1).Weekday()
+	return (w.hasDay(t.Weekday()) && minute >= from) || (w.hasDay(yesterday) && minute < to)
+}
+
+// TransferWindows is the calendar of the times transfers may run.
+type TransferWindows struct {
+	Allowed   []TimeWindow // transfers only run inside these windows, empty means always
+	Blocked   []TimeWindow // transfers never run inside these windows
+	Blackouts []Blackout   // one-off periods without transfers, like an announced maintenance
+}
+
+// Blackout is a one-off period, the times are YYYY-MM-DD or YYYY-MM-DD HH:MM in local time.
+// A date without time starts at the beginning of the day for from, and ends at the end of the day for to.
+type Blackout struct {
+	From string
+	To   string // empty means the end of the from day
+}
+
+const blackoutDate = "2006-01-02"
+const blackoutTime = "2006-01-02 15:04"
+
+// period returns the start and the end of the blackout.
+func (b Blackout) period() (time.Time, time.Time, error) {
+	from, err := time.ParseInLocation(blackoutTime, b.From, time.Local)
+	if err != nil {
+		from, err = time.ParseInLocation(blackoutDate, b.From, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Errorf("invalid blackout start %q, expected YYYY-MM-DD or YYYY-MM-DD HH:MM", b.From)
+		}
+	}
+	to := b.To
+	if to == "" {
+		to = from.Format(blackoutDate)
+	}
+	end, err := time.ParseInLocation(blackoutTime, to, time.Local)
+	if err != nil {
+		end, err = time.ParseInLocation(blackoutDate, to, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Errorf("invalid blackout end %q, expected YYYY-MM-DD or YYYY-MM-DD HH:MM", b.To)
+		}
+		end = end.AddDate(0, 0, 1)
+	}
+	if !end.After(from) {
+		return time.Time{}, time.Time{}, errors.Errorf("blackout %s ends before it starts", b.From)
+	}
+	return from, end, nil
+}
+
+func (w TransferWindows) validate() error {
+	for _, window := range append(append([]TimeWindow{}, w.Allowed...), w.Blocked...) {
+		if err := window.validate(); err != nil {
+			return err
+		}
+	}
+	for _, blackout := range w.Blackouts {
+		if _, _, err := blackout.period(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blackoutEnd returns the end of the blackout that contains the time, false if there is none.
+func (w TransferWindows) blackoutEnd(t time.Time) (time.Time, bool) {
+	for _, blackout := range w.Blackouts {
+		from, end, err := blackout.period()
+		if err == nil && !t.Before(from) && t.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// open reports whether transfers may run at the time.
+func (w TransferWindows) open(t time.Time) bool {
+	if _, ok := w.blackoutEnd(t); ok {
+		return false
+	}
+	for _, window := range w.Blocked {
+		if window.contains(t) {
+			return false
+		}
+	}
+	if len(w.Allowed) == 0 {
+		return true
+	}
+	for _, window := range w.Allowed {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpen returns the time the next window opens, false if no window opens within the next week after the blackouts.
+func (w TransferWindows) nextOpen(t time.Time) (time.Time, bool) {
+	// windows start at full minutes
+	next := t.Truncate(time.Minute)
+	for minutes := 0; minutes <= 8*24*60; minutes++ {
+		if end, ok := w.blackoutEnd(next); ok {
+			next = end
+			minutes = 0
+			continue
+		}
+		if next.After(t) && w.open(next) {
+			return next, true
+		}
+		next = next.Add(time.Minute)
+	}
+	return time.Time{}, false
+}
+
+// waitForWindow sleeps until transfers may run, the waits are logged for the job of the state.
+// It returns false if the context was canceled before.
+func (w TransferWindows) waitForWindow(ctx context.Context, state *TransferState) bool {
+	now := time.Now()
+	if w.open(now) {
+		return ctx.Err() == nil
+	}
+	next, ok := w.nextOpen(now)
+	if ok {
+		state.logf("outside of the transfer windows, the next window opens at %s\n", next.Format(time.RFC3339))
+	} else {
+		state.logf("outside of the transfer windows, no window opens within the next week\n")
+	}
+	// check every minute, so a changed clock doesn't delay the transfers
+	for !w.open(time.Now()) {
+		wait := time.Minute
+		if until := time.Until(next); ok && until > 0 && until < wait {
+			wait = until
+		}
+		if !sleepContext(ctx, wait) {
+			return false
+		}
+	}
+	state.logf("transfer window is open\n")
+	return true
+}
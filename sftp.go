@@ -3,11 +3,11 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	kh "golang.org/x/crypto/ssh/knownhosts"
@@ -25,56 +25,65 @@ func getKnownHostsFile(providedPath string) string {
 	}
 }
 
-var hostKeyCallback *ssh.HostKeyCallback
-var signer *ssh.Signer
+// sftpAuth caches the host keys and the parsed private key of a connection config,
+// so the key is not parsed again for every reconnect.
+type sftpAuth struct {
+	hostKeyCallback ssh.HostKeyCallback
+	signer          ssh.Signer
+}
+
+func connectTimeout(config *DirFsConfig) time.Duration {
+	if config.ConnectTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(config.ConnectTimeout) * time.Second
+}
 
-func createSftpClient(config *DirFsConfig) (*sftp.Client, error) {
+func createSftpClient(config *DirFsConfig, auth *sftpAuth) (*sftp.Client, *ssh.Client, error) {
 	var err error
-	if hostKeyCallback == nil {
-		hostKeyCallbackImpl, err := kh.New(getKnownHostsFile(config.KnownHosts))
+	if auth.hostKeyCallback == nil {
+		auth.hostKeyCallback, err = kh.New(getKnownHostsFile(config.KnownHosts))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		hostKeyCallback = &hostKeyCallbackImpl
 	}
 
 	privateKey, err := ioutil.ReadFile(config.IdentityFile)
 	if err != nil {
-		log.Fatalf("can't load identity file: %v", err)
+		return nil, nil, errors.Wrap(err, "can't load identity file")
 	}
 
-	if signer == nil {
-		var signerImpl ssh.Signer
+	if auth.signer == nil {
 		secret := config.Password
 		// Create the Signer for this private key.
 		if secret == "" {
-			signerImpl, err = ssh.ParsePrivateKey(privateKey)
+			auth.signer, err = ssh.ParsePrivateKey(privateKey)
 		} else {
-			signerImpl, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(secret))
+			auth.signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(secret))
 		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		signer = &signerImpl
 	}
 
 	sshClient := &ssh.ClientConfig{
 		User: config.Username,
 		Auth: []ssh.AuthMethod{
 			// Add in password check here for moar security.
-			ssh.PublicKeys(*signer),
+			ssh.PublicKeys(auth.signer),
 		},
-		HostKeyCallback: *hostKeyCallback,
-		Timeout:         10 * time.Second,
+		HostKeyCallback: auth.hostKeyCallback,
+		Timeout:         connectTimeout(config),
 	}
 	// Dial your ssh server.
 	conn, err := ssh.Dial("tcp", config.Host+":"+fmt.Sprint(config.Port), sshClient)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	client, err := sftp.NewClient(conn)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, nil, err
 	}
-	return client, nil
+	return client, conn, nil
 }
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+func (c ExecutionConfig) shutdownGrace() time.Duration {
+	if c.ShutdownGrace <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.ShutdownGrace) * time.Second
+}
+
+// sleepContext sleeps for the duration, it returns false if the context was canceled before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
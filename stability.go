@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// stabilityRecord tracks how long a source file has kept its size and modification time.
+type stabilityRecord struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // time the file was first seen with this size and modification time
+	scans   int       // number of scans that saw the file unchanged
+	seen    bool      // the file was seen in the current scan
+}
+
+// waitsForScans reports whether files are only transferred after they were seen unchanged by several scans
+// or for some time, the records of these scans are kept while the program runs.
+func (c ExecutionConfig) waitsForScans() bool {
+	return c.StableScans > 0 || c.StableSeconds > 0 || c.DatasetIdleSeconds > 0
+}
+
+// isStable reports whether the file is unchanged for the configured number of scans and seconds,
+// each call counts as one scan of the file.
+func (s *TransferState) isStable(path string, info os.FileInfo, config ExecutionConfig) bool {
+	if config.StableScans <= 0 && config.StableSeconds <= 0 {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	record, ok := s.stability[path]
+	if !ok || record.size != info.Size() || !record.modTime.Equal(info.ModTime()) {
+		record = &stabilityRecord{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			since:   now,
+		}
+		s.stability[path] = record
+	} else {
+		record.scans++
+	}
+	record.seen = true
+	return record.scans >= config.StableScans &&
+		now.Sub(record.since) >= time.Duration(config.StableSeconds)*time.Second
+}
+
+// resetStability forgets the file, so it has to become stable again before it's transferred.
+func (s *TransferState) resetStability(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.stability, path)
+}
+
+// beginScan must be called before the source is walked.
+func (s *TransferState) beginScan() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, record := range s.stability {
+		record.seen = false
+	}
+	for _, record := range s.datasets {
+		record.seen = false
+	}
+}
+
+// endScan forgets the files and datasets that were not seen in the scan.
+func (s *TransferState) endScan() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for path, record := range s.stability {
+		if !record.seen {
+			delete(s.stability, path)
+		}
+	}
+	for path, record := range s.datasets {
+		if !record.seen {
+			delete(s.datasets, path)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ResumeRecord describes an unfinished transfer, the partial file on the destination
+// is only resumed if the source file is still the same.
+type ResumeRecord struct {
+	Target  string    `json:"target"`          // target path on the destination
+	Size    int64     `json:"size"`            // size of the source file
+	ModTime time.Time `json:"mod-time"`        // modification time of the source file
+	Stale   bool      `json:"stale,omitempty"` // the partial file can't be resumed, it's removed when the destination is cleaned
+}
+
+func (r *ResumeRecord) matches(info os.FileInfo) bool {
+	return r.Size == info.Size() && r.ModTime.Equal(info.ModTime())
+}
+
+// TransferState keeps the state shared by the file move cycles,
+// the exported fields are saved to the state file so they survive a restart of the daemon.
+type TransferState struct {
+	path      string
+	job       string // name of the job, it prefixes the log messages
+	mutex     sync.Mutex
+	stability map[string]*stabilityRecord
+	datasets  map[string]*datasetRecord
+	bandwidth []*tokenBucket            // limit the rate of the transfers
+	Resume    map[string]*ResumeRecord  `json:"resume"`   // unfinished transfers by source path
+	Failures  map[string]*FailureRecord `json:"failures"` // failed transfers by source path
+	Copies    map[string]*CopyRecord    `json:"copies"`   // copies on the destinations by source path, for jobs with several destinations
+	Dustbin   map[string]*DustbinRecord `json:"-"`        // files in the dustbin by path, if a retention is configured, they are kept in a journal
+	Kept      map[string]*KeptRecord    `json:"-"`        // transferred files left in the source by path, they are kept in a journal
+}
+
+// LoadTransferState loads the state file, an empty state is returned if the file doesn't exist.
+// If path is empty, the state is kept in memory only.
+func LoadTransferState(path string) (*TransferState, error) {
+	state := &TransferState{
+		path:      path,
+		stability: make(map[string]*stabilityRecord),
+		datasets:  make(map[string]*datasetRecord),
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "can not open state file")
+		}
+		if err == nil {
+			err = json.Unmarshal(data, state)
+			if err != nil {
+				return nil, errors.Wrap(err, "can not unmarshal state file")
+			}
+		}
+	}
+	if state.Resume == nil {
+		state.Resume = make(map[string]*ResumeRecord)
+	}
+	if state.Failures == nil {
+		state.Failures = make(map[string]*FailureRecord)
+	}
+	if state.Copies == nil {
+		state.Copies = make(map[string]*CopyRecord)
+	}
+	state.Dustbin = make(map[string]*DustbinRecord)
+	if err := state.loadDustbin(); err != nil {
+		return nil, errors.Wrap(err, "can not load dustbin records")
+	}
+	state.Kept = make(map[string]*KeptRecord)
+	if err := state.loadKept(); err != nil {
+		return nil, errors.Wrap(err, "can not load kept files")
+	}
+	return state, nil
+}
+
+// logf logs a message of the job of the state.
+func (s *TransferState) logf(format string, v ...interface{}) {
+	if s == nil {
+		log.Printf(format, v...)
+		return
+	}
+	jobLogf(s.job, format, v...)
+}
+
+// save writes the state to a temporary file and renames it, so a crash never leaves a broken state file.
+// The mutex must be held by the caller.
+func (s *TransferState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// extensions of the journals next to the state file
+const (
+	keptJournal    = ".kept"
+	dustbinJournal = ".dustbin"
+)
+
+// journalPath returns the path of the journal next to the state file, empty if the state is kept in memory only.
+// The records that grow with every transfer are not written to the state file, which is rewritten on every change,
+// every change is appended to a journal instead.
+func (s *TransferState) journalPath(ext string) string {
+	if s.path == "" {
+		return ""
+	}
+	return s.path + ext
+}
+
+// appendJournal appends the entry as a line to the journal.
+func appendJournal(path string, entry interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readJournal replays the lines of the journal with apply. The journal is only read, so a dry run next to the daemon
+// doesn't change it.
+func (s *TransferState) readJournal(path string, apply func(line []byte) error) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := apply(scanner.Bytes()); err != nil {
+			// the last line may be incomplete after a crash
+			s.logf("skip broken line of the journal %s, the error is %v\n", path, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// writeJournal writes the journal again with only the current entries, so the removed records don't make it grow forever.
+func writeJournal(path string, entries []interface{}) error {
+	if path == "" {
+		return nil
+	}
+	if len(entries) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// compactJournals writes the journals again with only the current records. It's called when the job starts,
+// before the job appends to them.
+func (s *TransferState) compactJournals() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := writeJournal(s.journalPath(keptJournal), s.keptEntries()); err != nil {
+		return errors.Wrap(err, "can't compact the kept files")
+	}
+	if err := writeJournal(s.journalPath(dustbinJournal), s.dustbinEntries()); err != nil {
+		return errors.Wrap(err, "can't compact the dustbin records")
+	}
+	return nil
+}
+
+func (s *TransferState) resumeRecord(path string) *ResumeRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Resume[path]
+}
+
+func (s *TransferState) setResumeRecord(path string, record *ResumeRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Resume[path] = record
+	return s.save()
+}
+
+func (s *TransferState) removeResumeRecord(path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.Resume[path]; !ok {
+		return nil
+	}
+	delete(s.Resume, path)
+	return s.save()
+}
+
+// staleResumeRecords returns the records of the destination whose partial files can't be resumed, by key.
+func (s *TransferState) staleResumeRecords(dest *destination) map[string]ResumeRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stale := make(map[string]ResumeRecord)
+	for key, record := range s.Resume {
+		if record.Stale && dest.ownsResumeKey(key) {
+			stale[key] = *record
+		}
+	}
+	return stale
+}
+
+// pruneRemoved forgets the failures and the copies of the files that were removed from the source, so they don't
+// keep the job pending. The partial files of their unfinished transfers can't be resumed any more, their records
+// are marked stale. It reports whether a record was marked stale.
+func (s *TransferState) pruneRemoved(listing *sourceListing, dests []*destination) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := false
+	for path := range s.Failures {
+		if listing.removed(path) {
+			delete(s.Failures, path)
+			changed = true
+		}
+	}
+	for path := range s.Copies {
+		if listing.removed(path) {
+			delete(s.Copies, path)
+			changed = true
+		}
+	}
+	stale := false
+	for key, record := range s.Resume {
+		if record.Stale {
+			continue
+		}
+		for _, dest := range dests {
+			if dest.ownsResumeKey(key) && listing.removed(strings.TrimPrefix(key, dest.name+":")) {
+				record.Stale = true
+				stale = true
+				break
+			}
+		}
+	}
+	if changed || stale {
+		if err := s.save(); err != nil {
+			s.logf("can't save transfer state, the error is:\n%v", err)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sdNotify sends a state change like READY=1 to systemd,
+// it does nothing if the program is not started by a systemd service with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("can't notify systemd, the error is %v\n", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		log.Printf("can't notify systemd, the error is %v\n", err)
+	}
+}
+
+// activity tracks whether the file move makes progress, the systemd watchdog is only fed while it does.
+type activity struct {
+	last int64 // unix nano of the last progress, accessed atomically
+	busy int32 // number of jobs that are not waiting, accessed atomically
+}
+
+var moveActivity = &activity{last: time.Now().UnixNano()}
+
+// touch records progress, like a scanned folder, a transferred file or transferred data.
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// setWaiting marks whether a job starts or stops waiting, a wait is not a hang.
+// A job calls it with false when it starts and with true when it stops.
+func (a *activity) setWaiting(waiting bool) {
+	if waiting {
+		atomic.AddInt32(&a.busy, -1)
+	} else {
+		atomic.AddInt32(&a.busy, 1)
+	}
+	a.touch()
+}
+
+// activityReader records progress for every read, so a long read like the checksum of a large file
+// is not taken for a hang.
+type activityReader struct {
+	reader io.Reader
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		moveActivity.touch()
+	}
+	return n, err
+}
+
+// alive reports whether all jobs are waiting or the file move made progress within the timeout.
+func (a *activity) alive(timeout time.Duration) bool {
+	if atomic.LoadInt32(&a.busy) <= 0 {
+		return true
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last))) < timeout
+}
+
+// watchdogTimeout returns the timeout of the systemd watchdog, 0 if the watchdog is disabled.
+func watchdogTimeout() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog feeds the systemd watchdog while the file move makes progress, until the context is canceled.
+// If the file move hangs, systemd restarts the service.
+func runWatchdog(ctx context.Context) {
+	timeout := watchdogTimeout()
+	if timeout == 0 {
+		return
+	}
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if moveActivity.alive(timeout) {
+				sdNotify("WATCHDOG=1")
+			} else {
+				log.Printf("file move made no progress for %s, stop feeding the watchdog\n", timeout)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readCredential reads the credential of a systemd service from $CREDENTIALS_DIRECTORY,
+// false is returned if the service has no such credential.
+func readCredential(name string) (string, bool, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", false, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, errors.Wrapf(err, "can't read credential %s", name)
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errTransferStalled = errors.New("transfer stalled, no data was transferred within the idle timeout")
+var errTransferTimeout = errors.New("transfer exceeded the maximum duration")
+var errTransferAborted = errors.New("transfer aborted, the program is stopping")
+
+// progress records the time data was last transferred, so a stalled copy can be detected.
+type progress struct {
+	lastProgress int64 // unix nano, accessed atomically
+	reading      int32 // number of reads from the source in progress, accessed atomically
+}
+
+func (p *progress) touch() {
+	atomic.StoreInt64(&p.lastProgress, time.Now().UnixNano())
+	moveActivity.touch()
+}
+
+func (p *progress) last() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastProgress))
+}
+
+// read runs a read from the source, so a hanging copy shows whether it waits for the source or the destination.
+func (p *progress) read(read func() (int, error)) (int, error) {
+	atomic.AddInt32(&p.reading, 1)
+	defer atomic.AddInt32(&p.reading, -1)
+	return read()
+}
+
+// isReading reports whether the copy waits for the source.
+func (p *progress) isReading() bool {
+	return atomic.LoadInt32(&p.reading) > 0
+}
+
+type progressReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	progress *progress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	// a local copy is not interrupted by closing the connections
+	if r.ctx.Err() != nil {
+		return 0, errTransferAborted
+	}
+	n, err := r.progress.read(func() (int, error) {
+		return r.reader.Read(p)
+	})
+	if n > 0 {
+		r.progress.touch()
+	}
+	return n, err
+}
+
+// leftBehindError is returned if an aborted transfer doesn't stop even after its connection was dropped,
+// like a read that hangs in the kernel on a broken mount. The transfer is left behind, so it may still write
+// to the partial file, which can't be resumed.
+type leftBehindError struct {
+	cause error
+}
+
+func (e *leftBehindError) Error() string {
+	return e.cause.Error() + ", the transfer doesn't stop and is left behind"
+}
+
+func (e *leftBehindError) Unwrap() error {
+	return e.cause
+}
+
+// transferAborter stops a transfer. close closes the files of the transfer, so only this transfer fails.
+// If the transfer doesn't stop, because the connection doesn't answer any more, drop drops the connection
+// of the source if the transfer waits for a read, otherwise the connection of the destination.
+type transferAborter struct {
+	state *TransferState // the abort is logged for the job of the state
+	path  string         // path of the transferred file
+	close func()
+	drop  func(reading bool)
+}
+
+// abortGrace is the time an aborted transfer may take to stop after its files were closed.
+var abortGrace = 10 * time.Second
+
+type transferResult struct {
+	written int64
+	err     error
+}
+
+// maxTransferDuration returns the maximum duration of a transfer of the given size, 0 if unlimited.
+func (c ExecutionConfig) maxTransferDuration(size int64) time.Duration {
+	if c.TransferTimeoutPerGB <= 0 {
+		return 0
+	}
+	const gb = 1 << 30
+	gbs := (size + gb - 1) / gb
+	if gbs < 1 {
+		gbs = 1
+	}
+	return time.Duration(gbs) * time.Duration(c.TransferTimeoutPerGB) * time.Second
+}
+
+// copyWithTimeout copies like io.Copy, but calls abort if no data was copied within the idle timeout,
+// the copy exceeds the maximum duration or the context is canceled. abort must make the copy fail.
+func copyWithTimeout(ctx context.Context, dst io.Writer, src io.Reader, idleTimeout time.Duration, maxDuration time.Duration, abort transferAborter) (int64, error) {
+	if idleTimeout <= 0 && maxDuration <= 0 && ctx.Done() == nil {
+		return io.Copy(dst, src)
+	}
+	return watchTransfer(ctx, idleTimeout, maxDuration, abort, func(p *progress) (int64, error) {
+		return io.Copy(dst, &progressReader{ctx: ctx, reader: src, progress: p})
+	})
+}
+
+// watchTransfer runs the transfer, it calls abort if the transfer doesn't report progress within the idle timeout,
+// exceeds the maximum duration or the context is canceled.
+func watchTransfer(ctx context.Context, idleTimeout time.Duration, maxDuration time.Duration, abort transferAborter, transfer func(p *progress) (int64, error)) (int64, error) {
+	start := time.Now()
+	p := &progress{}
+	p.touch()
+	done := make(chan transferResult, 1)
+	go func() {
+		written, err := transfer(p)
+		done <- transferResult{written, err}
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-done:
+			return r.written, r.err
+		case <-ctx.Done():
+			return abortTransfer(errTransferAborted, abort, p, done)
+		case now := <-ticker.C:
+			var err error
+			if idleTimeout > 0 && now.Sub(p.last()) >= idleTimeout {
+				err = errTransferStalled
+			} else if maxDuration > 0 && now.Sub(start) >= maxDuration {
+				err = errTransferTimeout
+			}
+			if err == nil {
+				continue
+			}
+			return abortTransfer(err, abort, p, done)
+		}
+	}
+}
+
+// abortTransfer aborts the transfer and waits until it returns, so it doesn't use the files any more.
+// If it doesn't return within the grace period after its connection was dropped, it's left behind.
+func abortTransfer(err error, abort transferAborter, p *progress, done <-chan transferResult) (int64, error) {
+	abort.state.logf("abort transfer of file %s: %v\n", abort.path, err)
+	abort.close()
+	// the transfer fails once its files are closed
+	select {
+	case r := <-done:
+		return r.written, err
+	case <-time.After(abortGrace):
+	}
+	if abort.drop != nil {
+		if p.isReading() {
+			abort.state.logf("aborted transfer of file %s doesn't stop, drop the connection of the source\n", abort.path)
+		} else {
+			abort.state.logf("aborted transfer of file %s doesn't stop, drop the connection of the destination\n", abort.path)
+		}
+		abort.drop(p.isReading())
+	}
+	select {
+	case r := <-done:
+		return r.written, err
+	case <-time.After(abortGrace):
+		abort.state.logf("aborted transfer of file %s doesn't stop, leave it behind\n", abort.path)
+		return 0, &leftBehindError{cause: err}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// changeWatcher reports changes of the source, so the source is scanned when it changed instead of polling it.
+type changeWatcher interface {
+	// changes receives a value after the content of the source changed
+	changes() <-chan struct{}
+	close()
+}
+
+func (c ExecutionConfig) pollInterval() time.Duration {
+	if c.PollInterval <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.PollInterval) * time.Second
+}
+
+func (c *DirFsConfig) rescanInterval() time.Duration {
+	if c.RescanInterval <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.RescanInterval) * time.Second
+}
+
+// createChangeWatcher watches the source if watch mode is enabled, nil is returned if the source is polled.
+func createChangeWatcher(config DirFsConfig, state *TransferState) changeWatcher {
+	if !config.Watch {
+		return nil
+	}
+	if config.Type != Local {
+		state.logf("watch mode is only supported for local sources, poll the source\n")
+		return nil
+	}
+	watcher, err := newInotifyWatcher(config.Path, state)
+	if err != nil {
+		state.logf("can't watch the source, poll the source, the error is %v\n", err)
+		return nil
+	}
+	return watcher
+}
+
+// pending reports whether files are waiting for the next scan, like files that are not stable yet,
+// datasets that are not complete, failed or interrupted transfers, files that miss a copy. No event may report these files again.
+func (s *TransferState) pending() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.stability) > 0 || len(s.datasets) > 0 || len(s.Failures) > 0 || len(s.Resume) > 0 || len(s.Copies) > 0
+}
+
+// waitForNextScan sleeps until the source should be scanned again. Without a watcher the source is polled,
+// with a watcher it waits for a change or the rescan interval, the changes of a burst are handled in one scan.
+// It returns false if the context was canceled before.
+func waitForNextScan(ctx context.Context, watcher changeWatcher, config JobConfig, state *TransferState) bool {
+	pollInterval := config.Execution.pollInterval()
+	if watcher == nil || state.pending() {
+		return sleepContext(ctx, pollInterval)
+	}
+	rescan := time.NewTimer(config.Source.rescanInterval())
+	defer rescan.Stop()
+	select {
+	case <-watcher.changes():
+		if !sleepContext(ctx, pollInterval) {
+			return false
+		}
+	case <-rescan.C:
+		state.logf("rescan the source\n")
+	case <-ctx.Done():
+		return false
+	}
+	// the scan handles the changes that were reported in the meantime
+	select {
+	case <-watcher.changes():
+	default:
+	}
+	return true
+}
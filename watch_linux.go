@@ -0,0 +1,133 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// inotifyWatcher watches a local folder and all its subfolders with inotify.
+type inotifyWatcher struct {
+	fd      int
+	file    *os.File // reads the events, closing it stops the watcher
+	mutex   sync.Mutex
+	dirs    map[int32]string // watched folders by watch descriptor
+	changed chan struct{}
+	state   *TransferState // the errors are logged for the job of the state
+}
+
+func newInotifyWatcher(root string, state *TransferState) (*inotifyWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not initialize inotify")
+	}
+	w := &inotifyWatcher{
+		fd: fd,
+		// the file is non-blocking, so a read is interrupted when the file is closed
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		dirs:    make(map[int32]string),
+		changed: make(chan struct{}, 1),
+		state:   state,
+	}
+	err = w.addTree(root)
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// addTree watches the folder and its subfolders.
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// the folder may be removed already
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			if path == root {
+				return errors.Wrapf(err, "can not watch folder %s", path)
+			}
+			// the rescan finds the changes in the folder
+			w.state.logf("can't watch folder %s, the error is %v\n", path, err)
+			return nil
+		}
+		w.mutex.Lock()
+		w.dirs[int32(wd)] = path
+		w.mutex.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.state.logf("can't read inotify events, the error is %v\n", err)
+			}
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			w.handle(event, name)
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(event *syscall.InotifyEvent, name string) {
+	w.mutex.Lock()
+	dir, ok := w.dirs[event.Wd]
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		// the folder was removed
+		delete(w.dirs, event.Wd)
+	}
+	w.mutex.Unlock()
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		return
+	}
+	if ok && event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		// watch the new folder, files that were created in it before are found by the scan
+		w.addTree(filepath.Join(dir, name))
+	}
+	// IN_Q_OVERFLOW means events were lost, the scan finds the changes
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (w *inotifyWatcher) changes() <-chan struct{} {
+	return w.changed
+}
+
+func (w *inotifyWatcher) close() {
+	w.file.Close()
+}
+
+var _ changeWatcher = (*inotifyWatcher)(nil)
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "github.com/pkg/errors"
+
+func newInotifyWatcher(root string, state *TransferState) (changeWatcher, error) {
+	return nil, errors.New("watch mode is only supported on linux")
+}
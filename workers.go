@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+)
+
+// dirNode counts the unfinished files and subfolders of a folder in the walk.
+type dirNode struct {
+	parent  *dirNode
+	pending int    // files and subfolders that are not done
+	exited  bool   // the walk left the folder
+	exit    func() // called after the folder was exited and all its content is done
+}
+
+// workerPool transfers the files found by the walk in parallel.
+// The walk must call enterDir and exitDir for every folder it walks,
+// the exit function of a folder is called after all files in it and its subfolders are done.
+type workerPool struct {
+	tasks   chan func()
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	current *dirNode // folder the walk is in, only used by the walk
+}
+
+func (c ExecutionConfig) workers() int {
+	if c.Workers <= 0 {
+		return 1
+	}
+	return c.Workers
+}
+
+func newWorkerPool(workers int) *workerPool {
+	pool := &workerPool{
+		tasks:   make(chan func()),
+		current: &dirNode{},
+	}
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for task := range pool.tasks {
+				task()
+			}
+		}()
+	}
+	return pool
+}
+
+func (p *workerPool) enterDir() {
+	node := &dirNode{
+		parent: p.current,
+	}
+	p.mutex.Lock()
+	p.current.pending++
+	p.mutex.Unlock()
+	p.current = node
+}
+
+// submit runs the task of a file in the current folder, it blocks until a worker is free.
+func (p *workerPool) submit(task func()) {
+	node := p.current
+	p.mutex.Lock()
+	node.pending++
+	p.mutex.Unlock()
+	p.tasks <- func() {
+		task()
+		p.finish(node)
+	}
+}
+
+func (p *workerPool) exitDir(exit func()) {
+	node := p.current
+	p.current = node.parent
+	p.mutex.Lock()
+	node.exited = true
+	node.exit = exit
+	done := node.pending == 0
+	p.mutex.Unlock()
+	if done {
+		p.complete(node)
+	}
+}
+
+// finish marks one file or subfolder of the folder as done.
+func (p *workerPool) finish(node *dirNode) {
+	p.mutex.Lock()
+	node.pending--
+	done := node.exited && node.pending == 0
+	p.mutex.Unlock()
+	if done {
+		p.complete(node)
+	}
+}
+
+func (p *workerPool) complete(node *dirNode) {
+	node.exit()
+	if node.parent != nil {
+		p.finish(node.parent)
+	}
+}
+
+// wait waits until all files are done, the walk must be finished.
+func (p *workerPool) wait() {
+	close(p.tasks)
+	p.wg.Wait()
+}